@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	alertOpen     = "OPEN"
+	alertAcked    = "ACKED"
+	alertResolved = "RESOLVED"
+)
+
+type alertConfig struct {
+	// Window is a period in seconds that repeated notifications of the same
+	// incident are suppressed. 0 means no suppression.
+	Window int
+	// ResolveAfter is a period in seconds that an incident is resolved after
+	// the last occurrence. 0 means incidents are resolved only by INFO
+	// notifications.
+	ResolveAfter int
+}
+
+// incident is an alert identified by a target and a code(or a level if the
+// code is blank).
+type incident struct {
+	id           int64
+	target       string
+	key          string
+	status       string
+	level        string
+	code         string
+	count        int
+	suppressed   int
+	firstSeen    time.Time
+	lastSeen     time.Time
+	lastNotified time.Time
+	firstMessage string
+	lastMessage  string
+}
+
+func (inc *incident) toLua(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LNumber(inc.id))
+	tbl.RawSetString("target", lua.LString(inc.target))
+	tbl.RawSetString("key", lua.LString(inc.key))
+	tbl.RawSetString("status", lua.LString(inc.status))
+	tbl.RawSetString("level", lua.LString(inc.level))
+	tbl.RawSetString("code", lua.LString(inc.code))
+	tbl.RawSetString("count", lua.LNumber(inc.count))
+	tbl.RawSetString("suppressed", lua.LNumber(inc.suppressed))
+	tbl.RawSetString("first_seen", lua.LNumber(inc.firstSeen.Unix()))
+	tbl.RawSetString("last_seen", lua.LNumber(inc.lastSeen.Unix()))
+	tbl.RawSetString("first_message", lua.LString(inc.firstMessage))
+	tbl.RawSetString("last_message", lua.LString(inc.lastMessage))
+	return tbl
+}
+
+// alertManager tracks incidents of all targets. It is shared by workers and
+// survives reloads.
+type alertManager struct {
+	sync.Mutex
+	lastId    int64
+	incidents map[string]*incident
+}
+
+func newAlertManager() *alertManager {
+	return &alertManager{incidents: map[string]*incident{}}
+}
+
+func alertKey(level, code string) string {
+	if len(code) != 0 {
+		return code
+	}
+	return "level:" + level
+}
+
+func isRecoveryLevel(level string) bool {
+	lv := logLevelOf(level)
+	return lv == logLevelInfo || lv == logLevelDebug
+}
+
+// occur records an occurrence of the notification. It returns a copy of the
+// incident and whether the notification should be sent. INFO and DEBUG
+// notifications do not open incidents, they resolve incidents that have the
+// same code instead.
+func (am *alertManager) occur(target, level, code, message string, cfg *alertConfig) (*incident, bool) {
+	am.Lock()
+	defer am.Unlock()
+	now := time.Now()
+
+	if isRecoveryLevel(level) {
+		var resolved *incident
+		for id, inc := range am.incidents {
+			if inc.target != target || inc.code != code {
+				continue
+			}
+			delete(am.incidents, id)
+			inc.status = alertResolved
+			if resolved == nil || inc.id > resolved.id {
+				resolved = inc
+			}
+		}
+		if resolved == nil {
+			return nil, true
+		}
+		ret := *resolved
+		return &ret, true
+	}
+
+	key := alertKey(level, code)
+	id := target + "\x00" + key
+	inc, ok := am.incidents[id]
+	if !ok {
+		am.lastId++
+		inc = &incident{
+			id:           am.lastId,
+			target:       target,
+			key:          key,
+			status:       alertOpen,
+			level:        level,
+			code:         code,
+			firstSeen:    now,
+			lastNotified: now,
+			firstMessage: message,
+		}
+		am.incidents[id] = inc
+	}
+	inc.count++
+	inc.lastSeen = now
+	inc.lastMessage = message
+
+	send := true
+	switch {
+	case !ok:
+	case logLevelOf(level) > logLevelOf(inc.level):
+		// escalations are always notified and reopen the incident
+		inc.level = level
+		inc.status = alertOpen
+	case inc.status == alertAcked:
+		send = false
+	case cfg.Window > 0 && now.Sub(inc.lastNotified) < time.Duration(cfg.Window)*time.Second:
+		send = false
+	}
+	if !send {
+		inc.suppressed++
+		return nil, false
+	}
+	ret := *inc
+	inc.lastNotified = now
+	inc.suppressed = 0
+	return &ret, true
+}
+
+// due returns incidents of the target that need follow-up notifications.
+// Incidents that have been suppressed during the window are returned as
+// they are and incidents that have been quiet for cfg.ResolveAfter seconds
+// are returned as RESOLVED.
+func (am *alertManager) due(target string, cfg *alertConfig) []*incident {
+	am.Lock()
+	defer am.Unlock()
+	now := time.Now()
+	ret := []*incident{}
+	for id, inc := range am.incidents {
+		if inc.target != target {
+			continue
+		}
+		if inc.status != alertResolved && cfg.ResolveAfter > 0 && now.Sub(inc.lastSeen) >= time.Duration(cfg.ResolveAfter)*time.Second {
+			inc.status = alertResolved
+		}
+		if inc.status == alertResolved {
+			delete(am.incidents, id)
+			c := *inc
+			ret = append(ret, &c)
+			continue
+		}
+		if inc.status == alertOpen && inc.suppressed > 0 && now.Sub(inc.lastNotified) >= time.Duration(cfg.Window)*time.Second {
+			c := *inc
+			ret = append(ret, &c)
+			inc.lastNotified = now
+			inc.suppressed = 0
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].id < ret[j].id })
+	return ret
+}
+
+// setStatus changes the status of the incident. RESOLVED incidents are
+// notified by the worker of the target in the next interval.
+func (am *alertManager) setStatus(id int64, status string) error {
+	am.Lock()
+	defer am.Unlock()
+	for _, inc := range am.incidents {
+		if inc.id == id {
+			if inc.status == alertResolved {
+				return fmt.Errorf("incident %d is already resolved", id)
+			}
+			inc.status = status
+			return nil
+		}
+	}
+	return fmt.Errorf("incident %d not found", id)
+}
+
+// removeTarget removes incidents of the target.
+func (am *alertManager) removeTarget(target string) {
+	am.Lock()
+	defer am.Unlock()
+	for id, inc := range am.incidents {
+		if inc.target == target {
+			delete(am.incidents, id)
+		}
+	}
+}
+
+func (cfg *config) alert() *alertConfig {
+	if cfg.Alert == nil {
+		return &alertConfig{}
+	}
+	return cfg.Alert
+}
+
+func luaAckAlert(L *lua.LState) int {
+	th := goThread(L)
+	if err := th.shared.alerts.setStatus(int64(L.CheckInt(1)), alertAcked); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+func luaResolveAlert(L *lua.LState) int {
+	th := goThread(L)
+	if err := th.shared.alerts.setStatus(int64(L.CheckInt(1)), alertResolved); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gluamapper"
+	"github.com/yuin/gopher-lua"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type configChecker struct {
+	L        *lua.LState
+	config   *config
+	problems []string
+	// warnings are suspicious settings that do not fail the check.
+	warnings []string
+}
+
+// checkConfig loads the configuration file and validates it without
+// starting workers. It returns lists of problems and warnings found in the
+// file.
+func checkConfig(path string) ([]string, []string, error) {
+	th, err := newThread(path, &shared{logger: nil, alerts: newAlertManager(), limiter: newNotifierLimiter()})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer th.L.Close()
+	c := &configChecker{L: th.L, config: th.config, problems: []string{}, warnings: []string{}}
+	c.checkGlobals()
+
+	lcfg := th.L.GetGlobal(appName).(*lua.LTable)
+	ltargets := luaMustGetTableAttr(lcfg, "targets")
+	names := []string{}
+	for name, _ := range c.config.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.checkTarget(c.config.Targets[name], ltargets.RawGetString(name))
+	}
+	return c.problems, c.warnings, nil
+}
+
+func (c *configChecker) addProblem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configChecker) addWarning(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *configChecker) checkGlobals() {
+	cfg := c.config
+	if len(cfg.StatDir) == 0 {
+		c.addProblem("stat_dir must be specified")
+	} else if pathExists(cfg.StatDir) && !isDir(cfg.StatDir) {
+		c.addProblem("stat_dir %s is not a directory", cfg.StatDir)
+	}
+	switch cfg.logOutput() {
+	case "file":
+		if len(cfg.LogFile) == 0 {
+			c.addProblem("log_file must be specified")
+		}
+	case "syslog", "journald":
+	default:
+		c.addProblem("log_output: unknown output '%s'", cfg.LogOutput)
+	}
+	if lr := cfg.logRotation(); lr.MaxSize < 0 || lr.Generations < 0 {
+		c.addProblem("log_rotation: max_size and generations must not be negative numbers")
+	} else if lr.enabled() && cfg.logOutput() != "file" {
+		c.addProblem("log_rotation is available only for the file output")
+	}
+	if f := cfg.logFormat(); f != "text" && f != "json" {
+		c.addProblem("log_format: unknown format '%s'", cfg.LogFormat)
+	}
+	if _, err := cfg.syslog().facility(); err != nil {
+		c.addProblem("syslog: %s", err.Error())
+	}
+	if logLevelOf(cfg.LogLevel) == logLevelUnknown {
+		c.addProblem("log_level: unknown log level '%s'", cfg.LogLevel)
+	}
+	if len(cfg.HttpAddress) != 0 {
+		if _, _, err := net.SplitHostPort(cfg.HttpAddress); err != nil {
+			c.addProblem("http_address: %s", err.Error())
+		}
+	}
+	if cfg.StateSaveInterval < 0 {
+		c.addProblem("state_save_interval must not be a negative number")
+	}
+	if cfg.CommandTimeout < 0 {
+		c.addProblem("command_timeout must not be a negative number")
+	}
+	if cfg.Alert != nil {
+		if cfg.Alert.Window < 0 {
+			c.addProblem("alert.window must not be a negative number")
+		}
+		if cfg.Alert.ResolveAfter < 0 {
+			c.addProblem("alert.resolve_after must not be a negative number")
+		}
+	}
+	for name, rl := range cfg.RateLimits {
+		parts := strings.SplitN(name, ".", 2)
+		if name != "default" && (len(parts) != 2 || (parts[0] != "level" && parts[0] != "code")) {
+			c.addProblem("rate_limits: unknown notifier '%s'", name)
+		}
+		if rl.count() < 0 || rl.Period < 0 || rl.Digest < 0 {
+			c.addProblem("rate_limits.%s: count, period and digest must not be negative numbers", name)
+		}
+	}
+	if cfg.Delivery != nil && (cfg.Delivery.QueueSize < 0 || cfg.Delivery.RetryInterval < 0) {
+		c.addProblem("delivery: queue_size and retry_interval must not be negative numbers")
+	}
+	if cfg.OnSystemError == nil {
+		c.addProblem("on_system_error must be a function")
+	}
+	if cfg.Notifiers == nil || cfg.Notifiers.Default == nil {
+		c.addProblem("notifiers.default must be a function")
+	}
+	if cfg.Notifiers != nil {
+		for level, _ := range cfg.Notifiers.Level {
+			if logLevelOf(level) == logLevelUnknown {
+				c.addProblem("notifiers.level: unknown log level '%s'", level)
+			}
+		}
+	}
+}
+
+func (c *configChecker) checkTarget(t *target, lt lua.LValue) {
+	prefix := fmt.Sprintf("target %s", t.Path)
+	tbl, ok := lt.(*lua.LTable)
+	if !ok {
+		c.addProblem("%s: must be a table", prefix)
+		return
+	}
+	if err := gluamapper.Map(tbl, &target{}); err != nil {
+		c.addProblem("%s: %s", prefix, err.Error())
+	}
+
+	switch t.Type {
+	case "FILE", "CMD":
+	case "LUA":
+		if t.Fn == nil {
+			c.addProblem("%s: fn must be a function", prefix)
+		}
+	default:
+		c.addProblem("%s: unknown type '%s'", prefix, t.Type)
+	}
+	if len(t.Schedule) != 0 {
+		if _, err := parseSchedule(t.Schedule, time.Now()); err != nil {
+			c.addProblem("%s: schedule: %s", prefix, err.Error())
+		}
+	} else if t.Interval <= 0 {
+		c.addProblem("%s: interval must be a positive number", prefix)
+	}
+	if t.Splay < 0 {
+		c.addProblem("%s: splay must not be a negative number", prefix)
+	} else if len(t.Schedule) == 0 && t.Interval > 0 && t.Splay >= t.Interval {
+		c.addProblem("%s: splay must be less than the interval", prefix)
+	}
+	if t.Timeout < 0 {
+		c.addProblem("%s: timeout must not be a negative number", prefix)
+	}
+	if t.InitialState == nil {
+		c.addProblem("%s: initial_state must be a function", prefix)
+	} else if err := t.initState(c.L); err != nil {
+		c.addProblem("%s: initial_state: %s", prefix, err.Error())
+	}
+	if t.Multiline != nil {
+		if t.Type != "FILE" {
+			c.addProblem("%s: multiline is available only for target.FILE", prefix)
+		}
+		if err := t.Multiline.init(); err != nil {
+			c.addProblem("%s: multiline: invalid regexp: %s", prefix, err.Error())
+		}
+		if t.Multiline.FlushTimeout <= 0 && t.Interval <= 0 {
+			c.addProblem("%s: multiline: flush_timeout is required if the interval is not specified", prefix)
+		}
+	}
+	if len(t.Paths) != 0 && t.Type != "FILE" {
+		c.addProblem("%s: paths is available only for target.FILE", prefix)
+	}
+	for _, pattern := range t.Paths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			c.addProblem("%s: invalid path pattern '%s': %s", prefix, pattern, err.Error())
+		}
+	}
+	if len(t.Encoding) != 0 {
+		if _, err := lookupEncoding(t.Encoding); err != nil {
+			c.addProblem("%s: %s", prefix, err.Error())
+		}
+	}
+	if t.Watch && t.Type != "FILE" {
+		c.addProblem("%s: watch is available only for target.FILE", prefix)
+	}
+	if lv := tbl.RawGetString("state_version"); lv != lua.LNil && lv.Type() != lua.LTString {
+		c.addProblem("%s: state_version must be a string", prefix)
+	}
+	switch t.ExportMetrics.(type) {
+	case nil:
+	case bool, []interface{}:
+		if t.Type != "CMD" && t.Type != "LUA" {
+			c.addProblem("%s: export_metrics is available only for target.CMD and target.LUA", prefix)
+		}
+	default:
+		c.addProblem("%s: export_metrics must be a boolean or a list of field names", prefix)
+	}
+	if lparser := tbl.RawGetString("parser"); lparser != lua.LNil && t.Parser == nil {
+		c.addProblem("%s: parser must be a function", prefix)
+	}
+
+	for i, group := range t.FilterGroups {
+		for j, fil := range group {
+			c.checkFilter(fmt.Sprintf("%s: filter_groups[%d][%d]", prefix, i+1, j+1), fil)
+		}
+	}
+}
+
+func (c *configChecker) checkFilter(prefix string, fil *filter) {
+	switch fil.Type {
+	case "match", "notmatch":
+		if _, err := regexp.Compile(fil.Pattern); err != nil {
+			c.addProblem("%s: invalid regexp: %s", prefix, err.Error())
+		}
+	case "test":
+		if fil.Test == nil {
+			c.addProblem("%s: test must be a function", prefix)
+		} else if isThresholdFunc(fil.Test) {
+			c.checkThreshold(prefix, fil.Test.Upvalues[0].Value())
+		}
+	case "action":
+		if fil.Fn == nil {
+			c.addProblem("%s: fn must be a function", prefix)
+		}
+	case "notify":
+		c.checkNotify(prefix, fil)
+	default:
+		c.addProblem("%s: unknown filter type '%s'", prefix, fil.Type)
+	}
+}
+
+func (c *configChecker) checkNotify(prefix string, fil *filter) {
+	level := fil.Level
+	if level == "nil" {
+		level = ""
+	}
+	code := fil.Code
+	if code == "nil" {
+		code = ""
+	}
+	if len(level) != 0 && logLevelOf(level) == logLevelUnknown {
+		c.addProblem("%s: unknown log level '%s'", prefix, level)
+	}
+	if c.config.Notifiers == nil {
+		return
+	}
+	// codes without notifiers fall back to the level or default notifier,
+	// but they may be misspelled.
+	if len(code) != 0 {
+		if _, ok := c.config.Notifiers.Code[code]; !ok {
+			c.addWarning("%s: no notifier is defined for the code '%s', the level or default notifier is used", prefix, code)
+		}
+	}
+}
+
+func isThresholdFunc(fn *lua.LFunction) bool {
+	return fn.IsG && len(fn.Upvalues) == 1 &&
+		reflect.ValueOf(fn.GFunction).Pointer() == reflect.ValueOf(_luaThreshold).Pointer()
+}
+
+func (c *configChecker) checkThreshold(prefix string, lv lua.LValue) {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		c.addProblem("%s: threshold: invalid settings", prefix)
+		return
+	}
+	if len(lua.LVAsString(tbl.RawGetString("name"))) == 0 {
+		c.addProblem("%s: threshold: name must be specified", prefix)
+	}
+	if lcount := tbl.RawGetString("count"); lcount.Type() != lua.LTNumber || lua.LVAsNumber(lcount) < 0 {
+		c.addProblem("%s: threshold: count must be a number equal to or greater than 0", prefix)
+	}
+	val := lua.LVAsString(tbl.RawGetString("val"))
+	op, ok := tbl.RawGetString("op").(lua.LString)
+	if !ok {
+		c.addProblem("%s: threshold: op must be specified", prefix)
+		return
+	}
+	switch string(op) {
+	case "gt", "ge", "lt", "le", "ne", "eq":
+		if _, err := parseNumber(val); err != nil {
+			c.addProblem("%s: threshold: val must be a number: '%s'", prefix, val)
+		}
+	case "range":
+		ns := strings.Split(val, ",")
+		if len(ns) != 2 {
+			c.addProblem("%s: threshold: val must be 'min,max': '%s'", prefix, val)
+			return
+		}
+		for _, n := range ns {
+			if _, err := parseNumber(n); err != nil {
+				c.addProblem("%s: threshold: val must be 'min,max': '%s'", prefix, val)
+				return
+			}
+		}
+	default:
+		c.addProblem("%s: threshold: unknown op '%s'", prefix, string(op))
+	}
+}
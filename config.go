@@ -1,28 +1,54 @@
 package main
 
 import (
+	"fmt"
 	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 )
 
 type config struct {
-	StatDir       string
-	LogFile       string
-	LogLevel      string
-	OnSystemError *lua.LFunction
-	Downtime      *lua.LFunction
-
-	Targets   map[string]*target
-	Notifiers *notifiers
+	StatDir        string
+	LogFile        string
+	LogLevel       string
+	LogOutput      string
+	LogFormat      string
+	LogRotation    *logRotation
+	Syslog         *syslogConfig
+	CommandTimeout int
+	OnSystemError  *lua.LFunction
+	Downtime       *lua.LFunction
+	Alert          *alertConfig
+	Delivery       *deliveryConfig
+	HttpAddress    string
+	// StateSaveInterval is an interval in seconds of saving target states.
+	StateSaveInterval int
+	// MaxCrashes is a number of consecutive crashes until a target is
+	// marked as failed.
+	MaxCrashes int
+
+	Targets    map[string]*target
+	Notifiers  *notifiers
+	RateLimits map[string]*rateLimit
+
+	// fingerprint identifies the global settings(everything but targets).
+	fingerprint string
 }
 
-func loadConfig(L *lua.LState, path string) (*config, error) {
+func loadConfig(L *lua.LState, path string) (_ *config, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("invalid configuration: %v", e)
+		}
+	}()
 	cfg := config{}
-	err := L.DoFile(path)
+	err = L.DoFile(path)
 	if err != nil {
 		return nil, err
 	}
-	lcfg := L.GetGlobal(appName).(*lua.LTable)
+	lcfg, ok := L.GetGlobal(appName).(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table", appName)
+	}
 	err = gluamapper.Map(lcfg, &cfg)
 	if err != nil {
 		return nil, err
@@ -36,11 +62,27 @@ func loadConfig(L *lua.LState, path string) (*config, error) {
 		gluamapper.Map(value.(*lua.LTable), &t)
 		cfg.Targets[key.String()] = &t
 		t.Path = key.String()
+		t.fingerprint = luaFingerprint(value)
 	})
 	lnotifiers := luaMustGetTableAttr(lcfg, "notifiers")
 	cfg.Notifiers.Default = lnotifiers.RawGetString("default").(*lua.LFunction)
 	mapper.Map(luaMustGetTableAttr(lnotifiers, "code"), &cfg.Notifiers.Code)
 	mapper.Map(luaMustGetTableAttr(lnotifiers, "level"), &cfg.Notifiers.Level)
+	// keys of rate_limits are notifier names like "level.ERROR"
+	cfg.RateLimits = map[string]*rateLimit{}
+	if lrl, ok := lcfg.RawGetString("rate_limits").(*lua.LTable); ok {
+		if err := mapper.Map(lrl, &cfg.RateLimits); err != nil {
+			return nil, err
+		}
+	}
+
+	globals := L.NewTable()
+	lcfg.ForEach(func(key, value lua.LValue) {
+		if key.String() != "targets" {
+			globals.RawSet(key, value)
+		}
+	})
+	cfg.fingerprint = luaFingerprint(globals)
 
 	return &cfg, nil
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workerStatus is a status of the worker that can be read by other
+// goroutines.
+type workerStatus struct {
+	sync.Mutex
+	lastRun     time.Time
+	nextRun     time.Time
+	lastError   string
+	lastErrorAt time.Time
+	inDowntime  bool
+	paused      bool
+	failed      bool
+}
+
+func (ws *workerStatus) isPaused() bool {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.paused
+}
+
+func (ws *workerStatus) setPaused(paused bool) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.paused = paused
+}
+
+func (ws *workerStatus) setNextRun(t time.Time) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.nextRun = t
+}
+
+func (ws *workerStatus) setFailed(failed bool) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.failed = failed
+}
+
+// updateStatus copies the status of the worker after processing.
+func (wk *worker) updateStatus() {
+	wk.status.Lock()
+	defer wk.status.Unlock()
+	wk.status.lastRun = time.Now()
+	wk.status.lastError = wk.lastError
+	wk.status.lastErrorAt = wk.lastErrorAt
+	wk.status.inDowntime = wk.isInDowntime
+}
+
+func formatStatusTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (wk *worker) statusJson() map[string]interface{} {
+	wk.status.Lock()
+	defer wk.status.Unlock()
+	return map[string]interface{}{
+		"name":          wk.target.Path,
+		"type":          wk.target.Type,
+		"interval":      wk.target.Interval,
+		"schedule":      wk.target.Schedule,
+		"last_run":      formatStatusTime(wk.status.lastRun),
+		"next_run":      formatStatusTime(wk.status.nextRun),
+		"last_error":    wk.status.lastError,
+		"last_error_at": formatStatusTime(wk.status.lastErrorAt),
+		"in_downtime":   wk.status.inDowntime,
+		"paused":        wk.status.paused,
+		"failed":        wk.status.failed,
+	}
+}
+
+// control calls the function in the goroutine of the worker, so that the
+// function can access the LState of the worker. It returns false if the
+// worker has been stopped or crashed by the function.
+func (wk *worker) control(fn func()) bool {
+	donec := make(chan struct{})
+	select {
+	case wk.controlc <- func() { fn(); close(donec) }:
+	case <-wk.donec:
+		return false
+	}
+	select {
+	case <-donec:
+	case <-wk.donec:
+		return false
+	}
+	return true
+}
+
+// controlServer is a HTTP server that exposes statuses of targets and
+// controls them.
+type controlServer struct {
+	dp       *dispatcher
+	address  string
+	listener net.Listener
+}
+
+func newControlServer(dp *dispatcher, address string) (*controlServer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	cs := &controlServer{dp: dp, address: address, listener: ln}
+	go http.Serve(ln, cs)
+	return cs, nil
+}
+
+func (cs *controlServer) close() {
+	cs.listener.Close()
+}
+
+// workers returns running workers. Workers are read in the goroutine of the
+// dispatcher because they are replaced on reloads.
+func (cs *controlServer) workers() []*worker {
+	resc := make(chan []*worker, 1)
+	cs.dp.controlc <- func() {
+		ret := make([]*worker, 0, len(cs.dp.workers))
+		for _, wk := range cs.dp.workers {
+			ret = append(ret, wk)
+		}
+		resc <- ret
+	}
+	ret := <-resc
+	sort.Slice(ret, func(i, j int) bool { return ret[i].target.Path < ret[j].target.Path })
+	return ret
+}
+
+func (cs *controlServer) worker(name string) *worker {
+	for _, wk := range cs.workers() {
+		if wk.target.Path == name {
+			return wk
+		}
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func writeJsonError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJson(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// ServeHTTP serves the following endpoints. Target names must be escaped
+// because they usually contain slashes(i.e. /targets/%2Fvar%2Flog%2Fapp.log/state).
+//
+//   - GET /health
+//   - GET /metrics
+//   - GET /targets
+//   - GET /targets/{name}/state
+//   - POST /targets/{name}/(run|reset|pause|resume)
+func (cs *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/health":
+		writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	case path == "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		cs.dp.shared.metrics.write(w)
+		return
+	case path == "/targets":
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		ret := []interface{}{}
+		for _, wk := range cs.workers() {
+			ret = append(ret, wk.statusJson())
+		}
+		writeJson(w, http.StatusOK, ret)
+		return
+	case strings.HasPrefix(path, "/targets/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/targets/"), "/")
+		if len(parts) != 2 {
+			break
+		}
+		name, err := url.PathUnescape(parts[0])
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid target name: %s", err.Error())
+			return
+		}
+		cs.serveTarget(w, r, name, parts[1])
+		return
+	}
+	writeJsonError(w, http.StatusNotFound, "not found")
+}
+
+func (cs *controlServer) serveTarget(w http.ResponseWriter, r *http.Request, name, op string) {
+	method := "POST"
+	if op == "state" {
+		method = "GET"
+	}
+	switch op {
+	case "state", "run", "reset", "pause", "resume":
+	default:
+		writeJsonError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != method {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	wk := cs.worker(name)
+	if wk == nil {
+		writeJsonError(w, http.StatusNotFound, "target %s not found", name)
+		return
+	}
+
+	var ret interface{}
+	var err error
+	ok := wk.control(func() {
+		switch op {
+		case "state":
+			ret = luaToJsonValue(wk.target.State)
+		case "run":
+			wk.logger().info("target %s triggered via the control API.", name)
+			wk.process()
+		case "reset":
+			wk.logger().info("state of %s reset via the control API.", name)
+			err = wk.target.initState(wk.L)
+		case "pause":
+			wk.logger().info("target %s paused via the control API.", name)
+			wk.status.setPaused(true)
+		case "resume":
+			wk.logger().info("target %s resumed via the control API.", name)
+			wk.status.setPaused(false)
+		}
+	})
+	if !ok {
+		writeJsonError(w, http.StatusServiceUnavailable, "target %s has been stopped", name)
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	if op == "state" {
+		writeJson(w, http.StatusOK, ret)
+		return
+	}
+	writeJson(w, http.StatusOK, wk.statusJson())
+}
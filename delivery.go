@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const spoolDirName = "spool"
+
+type deliveryConfig struct {
+	// Async enables the asynchronous delivery.
+	Async bool
+	// QueueSize is a maximum number of notifications in the queue.
+	QueueSize int
+	// Retries is a maximum number of retries of each notification.
+	Retries int
+	// RetryInterval is an initial retry interval in seconds. Intervals are
+	// doubled for each retry.
+	RetryInterval int
+}
+
+func (cfg *config) delivery() *deliveryConfig {
+	if cfg.Delivery == nil {
+		return &deliveryConfig{}
+	}
+	return cfg.Delivery
+}
+
+func (dc *deliveryConfig) queueSize() int {
+	if dc.QueueSize <= 0 {
+		return 1000
+	}
+	return dc.QueueSize
+}
+
+func (dc *deliveryConfig) retries() int {
+	if dc.Retries < 0 {
+		return 0
+	}
+	if dc.Retries == 0 {
+		return 5
+	}
+	return dc.Retries
+}
+
+func (dc *deliveryConfig) backoff(attempts int) time.Duration {
+	interval := time.Duration(dc.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for i := 1; i < attempts && interval < 5*time.Minute; i++ {
+		interval *= 2
+	}
+	if interval > 5*time.Minute {
+		interval = 5 * time.Minute
+	}
+	return interval
+}
+
+// notification is a notification that is waiting for the delivery. Lua
+// values are converted by luaToSpoolValue so that they can be written into
+// the spool directory.
+type notification struct {
+	Id        string
+	Target    string
+	Path      string
+	Notifier  string
+	Message   string
+	Level     string
+	Code      string
+	State     interface{}
+	Obj       interface{}
+	Incident  interface{}
+	Lines     []string
+	Attempts  int
+	CreatedAt time.Time
+
+	spoolPath string
+	nextAt    time.Time
+}
+
+var notificationSeq uint64
+
+func newNotification(target, path, notifier, message, level, code string, state, obj, incident lua.LValue) *notification {
+	return &notification{
+		Id:        fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), atomic.AddUint64(&notificationSeq, 1)%1000000),
+		Target:    target,
+		Path:      path,
+		Notifier:  notifier,
+		Message:   message,
+		Level:     level,
+		Code:      code,
+		State:     luaToSpoolValue(state),
+		Obj:       luaToSpoolValue(obj),
+		Incident:  luaToSpoolValue(incident),
+		CreatedAt: time.Now(),
+	}
+}
+
+// luaToSpoolValue converts the value into a value that can be encoded by
+// the encoding/json. nqueues are converted into tables that have a
+// "$nqueue" key.
+func luaToSpoolValue(lv lua.LValue) interface{} {
+	if ud, ok := lv.(*lua.LUserData); ok {
+		if q, ok := ud.Value.(*nqueue); ok {
+			d := make([]interface{}, 0, len(q.d))
+			for _, v := range q.d {
+				d = append(d, float64(v))
+			}
+			return map[string]interface{}{"$nqueue": d, "$capa": float64(q.capa)}
+		}
+		return nil
+	}
+	if tbl, ok := lv.(*lua.LTable); ok {
+		ret := map[string]interface{}{}
+		tbl.ForEach(func(key, value lua.LValue) {
+			if v := luaToSpoolValue(value); v != nil {
+				ret[key.String()] = v
+			}
+		})
+		return ret
+	}
+	return luaToJsonValue(lv)
+}
+
+func spoolValueToLua(L *lua.LState, value interface{}) lua.LValue {
+	if m, ok := value.(map[string]interface{}); ok {
+		if d, ok := m["$nqueue"].([]interface{}); ok {
+			capa, _ := m["$capa"].(float64)
+			q := &nqueue{int(capa), []lua.LNumber{}}
+			for _, v := range d {
+				if n, ok := v.(float64); ok {
+					q.d = append(q.d, lua.LNumber(n))
+				}
+			}
+			ud := L.NewUserData()
+			ud.Value = q
+			L.SetMetatable(ud, L.GetTypeMetatable(nqueueName))
+			return ud
+		}
+		tbl := L.NewTable()
+		for k, v := range m {
+			// keys of arrays are restored as numbers
+			if n, err := parseNumber(k); err == nil {
+				tbl.RawSet(lua.LNumber(n), spoolValueToLua(L, v))
+			} else {
+				tbl.RawSetString(k, spoolValueToLua(L, v))
+			}
+		}
+		return tbl
+	}
+	return jsonToLua(L, value)
+}
+
+// deliverer calls notifiers in its own goroutine and LState.
+type deliverer struct {
+	*thread
+	queuec  chan *notification
+	quitc   chan *sync.WaitGroup
+	reloadc chan *thread
+
+	// retrying notifications sorted by nextAt.
+	retrying []*notification
+	// overflowed is set to 1 if notifications are left in the spool
+	// directory because the queue is full.
+	overflowed int32
+	// ids of notifications that are queued, being delivered or retrying.
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+func newDeliverer(path string, s *shared) (*deliverer, error) {
+	th, err := newThread(path, s)
+	if err != nil {
+		return nil, err
+	}
+	return &deliverer{
+		thread:   th,
+		queuec:   make(chan *notification, th.config.delivery().queueSize()),
+		quitc:    make(chan *sync.WaitGroup),
+		reloadc:  make(chan *thread),
+		retrying: []*notification{},
+		pending:  map[string]bool{},
+	}, nil
+}
+
+// enqueue writes the notification into the spool directory and adds it to
+// the queue. This is called by workers, so that errors are written by the
+// logger of the caller. The thread of the deliverer must not be accessed here
+// because it is replaced on reloads.
+func (dl *deliverer) enqueue(logger *contextLogger, statDir string, n *notification) {
+	n.spoolPath = filepath.Join(statDir, spoolDirName, n.Id+".json")
+	data, err := json.Marshal(n)
+	if err != nil {
+		logger.error("can not encode the notification %s: %s", n.Id, err.Error())
+	} else if err := writeFile(string(data), n.spoolPath+".tmp"); err != nil {
+		logger.error("can not write the spool file %s: %s", n.spoolPath, err.Error())
+	} else if err := os.Rename(n.spoolPath+".tmp", n.spoolPath); err != nil {
+		logger.error("can not write the spool file %s: %s", n.spoolPath, err.Error())
+	}
+	dl.setPending(n.Id, true)
+	select {
+	case dl.queuec <- n:
+	default:
+		dl.setPending(n.Id, false)
+		atomic.StoreInt32(&dl.overflowed, 1)
+		logger.warn("delivery queue is full, notification %s of %s is left in the spool directory.", n.Id, n.Target)
+	}
+}
+
+// loadSpool adds notifications in the spool directory to the queue.
+func (dl *deliverer) loadSpool() {
+	dir := filepath.Join(dl.config.StatDir, spoolDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dl.logger().error("can not read the spool directory %s: %s", dir, err.Error())
+		}
+		return
+	}
+	names := []string{}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".json") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spoolPath := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(spoolPath)
+		if err != nil {
+			dl.logger().error("can not read the spool file %s: %s", spoolPath, err.Error())
+			continue
+		}
+		n := &notification{}
+		if err := json.Unmarshal(data, n); err != nil {
+			dl.logger().error("broken spool file %s: %s", spoolPath, err.Error())
+			os.Remove(spoolPath)
+			continue
+		}
+		if !dl.setPending(n.Id, true) {
+			continue
+		}
+		n.spoolPath = spoolPath
+		select {
+		case dl.queuec <- n:
+		default:
+			dl.setPending(n.Id, false)
+			atomic.StoreInt32(&dl.overflowed, 1)
+			return
+		}
+	}
+}
+
+func (dl *deliverer) run() {
+	dl.loadSpool()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case wg := <-dl.quitc:
+			dl.L.Close()
+			wg.Done()
+			return
+		case th := <-dl.reloadc:
+			dl.L.Close()
+			dl.thread = th
+		case n := <-dl.queuec:
+			dl.deliver(n)
+		case <-ticker.C:
+			now := time.Now()
+			for len(dl.retrying) > 0 && !dl.retrying[0].nextAt.After(now) {
+				n := dl.retrying[0]
+				dl.retrying = dl.retrying[1:]
+				dl.deliver(n)
+			}
+			if len(dl.queuec) == 0 && atomic.CompareAndSwapInt32(&dl.overflowed, 1, 0) {
+				dl.loadSpool()
+			}
+		}
+	}
+}
+
+func (dl *deliverer) stop() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	dl.quitc <- &wg
+	wg.Wait()
+}
+
+// deliver calls the notifier. Notifiers that raise an error or return false
+// are retried later.
+func (dl *deliverer) deliver(n *notification) {
+	L := dl.L
+	n.Attempts++
+	dl.currentPath = n.Path
+	ctx := logContext{target: n.Target}
+	logger := &contextLogger{dl.shared.logger, &ctx}
+	// logs written by the notifier and the on_system_error carry the target
+	// of this notification. The logCtx of the deliverer is accessed only in
+	// its own goroutine.
+	dl.logCtx = ctx
+	defer func() { dl.logCtx = logContext{} }()
+	dl.matchedLines = n.Lines
+	state, ok := spoolValueToLua(L, n.State).(*lua.LTable)
+	if !ok {
+		state = L.NewTable()
+	}
+	var inc lua.LValue = lua.LNil
+	if n.Incident != nil {
+		inc = spoolValueToLua(L, n.Incident)
+	}
+	fn := dl.config.notifierByName(n.Notifier)
+	err := dl.callLua(fn, 1, state, spoolValueToLua(L, n.Obj), lua.LString(n.Message), lua.LString(n.Level), lua.LString(n.Code), inc)
+	if err == nil && dl.popLuaRet() == lua.LFalse {
+		err = fmt.Errorf("the notifier returned false")
+	}
+	if err == nil {
+		dl.done(n)
+		return
+	}
+
+	dc := dl.config.delivery()
+	if n.Attempts > dc.retries() {
+		dl.systemError(logLevelError.String(), "gave up delivering the notification %s of %s after %d attempts: %s", n.Id, n.Target, n.Attempts, err.Error())
+		dl.done(n)
+		return
+	}
+	n.nextAt = time.Now().Add(dc.backoff(n.Attempts))
+	logger.warn("failed to deliver the notification %s of %s, retrying at %s: %s", n.Id, n.Target, n.nextAt.Format(time.RFC3339), err.Error())
+	dl.retrying = append(dl.retrying, n)
+	sort.SliceStable(dl.retrying, func(i, j int) bool { return dl.retrying[i].nextAt.Before(dl.retrying[j].nextAt) })
+}
+
+// setPending marks the notification as pending or not. It returns false if
+// the notification is already pending.
+func (dl *deliverer) setPending(id string, pending bool) bool {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	if !pending {
+		delete(dl.pending, id)
+		return true
+	}
+	if dl.pending[id] {
+		return false
+	}
+	dl.pending[id] = true
+	return true
+}
+
+func (dl *deliverer) done(n *notification) {
+	dl.setPending(n.Id, false)
+	if len(n.spoolPath) != 0 {
+		if err := os.Remove(n.spoolPath); err != nil && !os.IsNotExist(err) {
+			dl.logger().error("can not remove the spool file %s: %s", n.spoolPath, err.Error())
+		}
+	}
+}
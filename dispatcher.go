@@ -1,29 +1,68 @@
 package main
 
 import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"os"
 	"sync"
+	"time"
 )
 
 type dispatcher struct {
 	*thread
-	exitc chan int
+	path    string
+	exitc   chan int
+	reloadc chan int
+	// debugc toggles the DEBUG log level.
+	debugc chan int
+	// levelBeforeDebug is the log level before it was switched to DEBUG by
+	// the debugc, logLevelUnknown if it is not switched.
+	levelBeforeDebug logLevel
+	// controlc receives functions called by the control API.
+	controlc chan func()
+	control  *controlServer
+	// restartc receives paths of crashed targets to be restarted.
+	restartc chan string
 
-	workers []*worker
+	workers map[string]*worker
+	crashes map[string]*crashState
 }
 
 func newDispathcer(path string) *dispatcher {
 	dp := &dispatcher{
 		thread: mustNewThread(path, &shared{
-			logger: nil,
-			quitc:  make(chan *sync.WaitGroup),
+			logger:  nil,
+			alerts:  newAlertManager(),
+			limiter: newNotifierLimiter(),
+			metrics: newMetricsRegistry(),
+			crashc:  make(chan *workerCrash),
 		}),
-		exitc:   make(chan int),
-		workers: []*worker{},
+		path:     path,
+		exitc:    make(chan int),
+		reloadc:  make(chan int),
+		debugc:   make(chan int),
+		controlc: make(chan func()),
+		restartc: make(chan string),
+		workers:  map[string]*worker{},
+		crashes:  map[string]*crashState{},
 	}
-	dp.shared.logger = newLogger(appName, dp.config.LogFile, logLevelOf(dp.config.LogLevel))
+	dp.shared.logger = newLogger(appName, logOptionsOf(dp.config), logLevelOf(dp.config.LogLevel))
+	dl, err := newDeliverer(path, dp.shared)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can not load %s:\n\n%s", path, err.Error())
+		os.Exit(1)
+	}
+	dp.shared.deliverer = dl
 
 	for fpath, _ := range dp.config.Targets {
-		dp.workers = append(dp.workers, newWorker(path, fpath, dp.shared))
+		wk, err := newWorker(path, fpath, dp.shared)
+		if err != nil {
+			// other targets keep running
+			dp.handleCrash(&workerCrash{path: fpath, message: err.Error()})
+			continue
+		}
+		wk.restoreState()
+		dp.workers[fpath] = wk
 	}
 	return dp
 }
@@ -31,24 +70,218 @@ func newDispathcer(path string) *dispatcher {
 func (dp *dispatcher) run() {
 	logger := dp.shared.logger
 	logger.info("starting logias.")
+	go dp.shared.deliverer.run()
 	for _, worker := range dp.workers {
 		go worker.run()
 	}
+	dp.startControl(dp.config.HttpAddress)
 	logger.info("%s", "logias started.")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ticker.C:
+			dp.deliverDigests()
+		case <-dp.reloadc:
+			dp.reload()
+		case <-dp.debugc:
+			dp.toggleDebug()
+		case fn := <-dp.controlc:
+			fn()
+		case c := <-dp.shared.crashc:
+			dp.handleCrash(c)
+		case path := <-dp.restartc:
+			dp.restartWorker(path)
 		case <-dp.exitc:
 			logger.info("stopping logias.")
+			dp.startControl("")
 			logger.info("waiting for workers.")
 			var wg sync.WaitGroup
 			wg.Add(len(dp.workers))
-			for range dp.workers {
-				dp.shared.quitc <- &wg
+			for _, worker := range dp.workers {
+				worker.cancel()
+			}
+			for _, worker := range dp.workers {
+				worker.quit(&wg)
 			}
 			wg.Wait()
+			// undelivered notifications are left in the spool directory
+			dp.shared.deliverer.stop()
 			logger.info("logias stopped.")
 			logger.closeFile()
 			return
 		}
 	}
 }
+
+// reload reloads the configuration file. Workers whose target definition is
+// not changed keep running. If global settings are changed, all workers are
+// rebuilt and target states are carried over to the new workers.
+func (dp *dispatcher) reload() {
+	logger := dp.shared.logger
+	logger.info("reloading %s.", dp.path)
+	th, err := newThread(dp.path, dp.shared)
+	if err != nil {
+		dp.reloadError(err)
+		return
+	}
+	// log settings are validated before touching running workers
+	logOpts := logOptionsOf(th.config)
+	if logOpts != logOptionsOf(dp.config) {
+		if err := checkLogOptions(logOpts); err != nil {
+			th.L.Close()
+			dp.reloadError(err)
+			return
+		}
+	}
+	globalChanged := th.config.fingerprint != dp.config.fingerprint
+	var dth *thread
+	if globalChanged {
+		if dth, err = newThread(dp.path, dp.shared); err != nil {
+			th.L.Close()
+			dp.reloadError(err)
+			return
+		}
+	}
+
+	// all workers are created before touching running workers. Running
+	// workers of targets that can not be initialized are kept, other targets
+	// that can not be initialized are handled as crashes.
+	created := map[string]*worker{}
+	initErrors := map[string]string{}
+	for fpath, t := range th.config.Targets {
+		if old, ok := dp.workers[fpath]; ok && !globalChanged && old.target.fingerprint == t.fingerprint && !dp.isCrashed(fpath) {
+			continue
+		}
+		wk, err := newWorker(dp.path, fpath, dp.shared)
+		if err != nil {
+			initErrors[fpath] = err.Error()
+			continue
+		}
+		created[fpath] = wk
+	}
+
+	for fpath, wk := range dp.workers {
+		if _, ok := th.config.Targets[fpath]; !ok {
+			wk.stop()
+			wk.removeSavedState()
+			delete(dp.workers, fpath)
+			dp.shared.alerts.removeTarget(fpath)
+			dp.shared.metrics.removeTarget(fpath)
+			logger.info("target %s removed.", fpath)
+		}
+	}
+	for fpath, _ := range dp.crashes {
+		if _, ok := th.config.Targets[fpath]; !ok {
+			delete(dp.crashes, fpath)
+			dp.shared.metrics.removeTarget(fpath)
+		}
+	}
+	for fpath, wk := range created {
+		if old, ok := dp.workers[fpath]; ok {
+			old.stop()
+			if old.target.fingerprint == wk.target.fingerprint {
+				wk.target.State = luaCopyValue(wk.L, old.target.State).(*lua.LTable)
+				wk.isInDowntime = old.isInDowntime
+				wk.status.setPaused(old.status.isPaused())
+				logger.info("target %s restarted.", fpath)
+			} else {
+				// the state saved by the stopped worker is restored
+				wk.restoreState()
+				logger.info("target %s changed.", fpath)
+			}
+		} else {
+			wk.restoreState()
+			logger.info("target %s added.", fpath)
+		}
+		dp.workers[fpath] = wk
+		// pending restarts are cancelled and failed targets are retried
+		delete(dp.crashes, fpath)
+		dp.shared.metrics.remove("logias_target_failed", "target", fpath)
+		go wk.run()
+	}
+
+	if dth != nil {
+		dp.shared.deliverer.reloadc <- dth
+	}
+	if err := logger.changeOptions(logOpts); err != nil {
+		dp.systemError(logLevelError.String(), "log settings are not changed: %s", err.Error())
+	}
+	logger.setLogLevel(logLevelOf(th.config.LogLevel))
+	dp.levelBeforeDebug = logLevelUnknown
+	if th.config.HttpAddress != dp.config.HttpAddress {
+		dp.startControl(th.config.HttpAddress)
+	}
+	dp.L.Close()
+	dp.thread = th
+	for fpath, msg := range initErrors {
+		if _, ok := dp.workers[fpath]; ok && !dp.isCrashed(fpath) {
+			// the running worker keeps the previous definition
+			dp.systemError(logLevelError.String(), "target %s is not changed: %s", fpath, msg)
+			continue
+		}
+		delete(dp.workers, fpath)
+		delete(dp.crashes, fpath)
+		dp.shared.metrics.remove("logias_target_failed", "target", fpath)
+		dp.handleCrash(&workerCrash{path: fpath, message: msg})
+	}
+	logger.info("%s reloaded.", dp.path)
+}
+
+// startControl (re)starts the control API server. An empty address stops the
+// server.
+func (dp *dispatcher) startControl(address string) {
+	if dp.control != nil {
+		dp.control.close()
+		dp.shared.logger.info("control API on %s stopped.", dp.control.address)
+		dp.control = nil
+	}
+	if len(address) == 0 {
+		return
+	}
+	cs, err := newControlServer(dp, address)
+	if err != nil {
+		dp.systemError(logLevelError.String(), "can not start the control API on %s: %s", address, err.Error())
+		return
+	}
+	dp.control = cs
+	dp.shared.logger.info("control API listening on %s.", address)
+}
+
+// toggleDebug switches the log level to DEBUG and back to the previous level.
+func (dp *dispatcher) toggleDebug() {
+	logger := dp.shared.logger
+	old := logger.logLevel()
+	if dp.levelBeforeDebug != logLevelUnknown {
+		logger.setLogLevel(dp.levelBeforeDebug)
+		dp.levelBeforeDebug = logLevelUnknown
+		logger.info("log level changed from %s to %s.", old.String(), logger.logLevel().String())
+		return
+	}
+	if old == logLevelDebug {
+		logger.info("log level is already DEBUG.")
+		return
+	}
+	dp.levelBeforeDebug = old
+	logger.setLogLevel(logLevelDebug)
+	logger.info("log level changed from %s to %s.", old.String(), logLevelDebug.String())
+}
+
+// deliverDigests sends aggregated notifications of notifiers that exceeded
+// their rate limits.
+func (dp *dispatcher) deliverDigests() {
+	for _, b := range dp.shared.limiter.due(dp.config.RateLimits) {
+		if dp.config.delivery().Async {
+			dp.shared.deliverer.enqueue(dp.logger(), dp.config.StatDir, newNotification("", "", b.name, b.message(), b.level, b.code, lua.LNil, b.toLua(dp.L), lua.LNil))
+			continue
+		}
+		fn := dp.config.notifierByName(b.name)
+		if err := dp.callLua(fn, 0, dp.L.NewTable(), b.toLua(dp.L), lua.LString(b.message()), lua.LString(b.level), lua.LString(b.code), lua.LNil); err != nil {
+			dp.systemError(logLevelError.String(), "error while calling the notify function %s: %s", b.name, err.Error())
+		}
+	}
+}
+
+func (dp *dispatcher) reloadError(err error) {
+	dp.systemError(logLevelError.String(), "can not reload %s: %s", dp.path, err.Error())
+}
@@ -18,8 +18,13 @@ type filter struct {
 	regexp *regexp.Regexp
 }
 
-func (fil *filter) init() {
+func (fil *filter) init() error {
 	if fil.Type == "match" || fil.Type == "notmatch" {
-		fil.regexp = regexp.MustCompile(fil.Pattern)
+		re, err := regexp.Compile(fil.Pattern)
+		if err != nil {
+			return err
+		}
+		fil.regexp = re
 	}
+	return nil
 }
@@ -125,8 +125,16 @@ case "$1" in
   fi
   ;;
 
+  reload)
+  ${DAEMON} check ${DAEMONARGS} || exit 1
+  $0 status > /dev/null 2>&1
+  if [ $? -eq 0 ]; then # program is running
+    cat ${PIDFILE} | xargs kill -HUP
+  fi
+  ;;
+
   *)
-  echo "Usage: $SCRIPTNAME {start|stop|restart|status|rotate}" >&2
+  echo "Usage: $SCRIPTNAME {start|stop|restart|status|rotate|reload}" >&2
   RETVAL=3
   ;;
 
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"time"
 )
 
 type logLevel int
@@ -55,43 +57,191 @@ func logLevelOf(value string) logLevel {
 type logger struct {
 	logger   *log.Logger
 	name     string
-	path     string
+	opts     logOptions
 	logfile  *os.File
 	loglevel logLevel
 	lock     chan int
+	sink     logSink
+	// size of the log file and the day when the log file was opened, used
+	// for rotations.
+	size      int64
+	openedDay string
+	// rotations are not retried until the rotateRetryAt after a failure.
+	rotateFailed  bool
+	rotateRetryAt time.Time
+	// compressing is closed when the compression of the rotated file is
+	// finished.
+	compressing chan struct{}
 }
 
-func newLogger(name, filePath string, loglevel logLevel) *logger {
-	self := &logger{logger: nil, name: name, path: filePath, logfile: nil, loglevel: loglevel, lock: make(chan int, 1)}
+// logOptions is a set of logger settings taken from the config.
+type logOptions struct {
+	path string
+	// output is one of "file", "syslog" and "journald".
+	output string
+	// format is one of "text" and "json".
+	format   string
+	syslog   syslogConfig
+	rotation logRotation
+}
+
+func logOptionsOf(cfg *config) logOptions {
+	return logOptions{
+		path:     cfg.LogFile,
+		output:   cfg.logOutput(),
+		format:   cfg.logFormat(),
+		syslog:   *cfg.syslog(),
+		rotation: *cfg.logRotation(),
+	}
+}
+
+// logContext is a context attached to logs.
+type logContext struct {
+	target     string
+	targetType string
+}
+
+const (
+	logKindSystem      = "system"
+	logKindLua         = "log"
+	logKindSystemError = "system_error"
+	// logKindTrace is a kind of traces of targets that have the debug flag.
+	// Traces are written regardless of the log level.
+	logKindTrace = "trace"
+)
+
+func newLogger(name string, opts logOptions, loglevel logLevel) *logger {
+	self := &logger{logger: nil, name: name, opts: opts, logfile: nil, loglevel: loglevel, lock: make(chan int, 1)}
 	self.lock <- 1
-	self._openLogFile()
+	if err := self._openLogFile(opts); err != nil {
+		panic(err.Error())
+	}
 	return self
 }
 
-func (self *logger) _openLogFile() {
-	f, err := os.OpenFile(self.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+func (self *logger) _newLogger(w io.Writer) *log.Logger {
+	if self.opts.format == "json" {
+		return log.New(w, "", 0)
+	}
+	return log.New(w, fmt.Sprintf("%v\t", self.name), log.LstdFlags)
+}
+
+// _openLogFile opens the log file or the sink of the options and replaces
+// current ones. Current ones are kept if it fails.
+func (self *logger) _openLogFile(opts logOptions) error {
+	switch opts.output {
+	case "syslog":
+		sink, err := newSyslogSink(&opts.syslog)
+		if err != nil {
+			return fmt.Errorf("error opening syslog: %v", err)
+		}
+		self._closeFile()
+		self.opts = opts
+		self.sink = newAsyncSink(opts.output, sink)
+		self.logger = self._newLogger(os.Stdout)
+		return nil
+	case "journald":
+		self._closeFile()
+		self.opts = opts
+		self.sink = newAsyncSink(opts.output, newJournalSink(&opts.syslog))
+		self.logger = self._newLogger(os.Stdout)
+		return nil
+	}
+	f, err := os.OpenFile(opts.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 
 	if err != nil {
-		panic(fmt.Sprintf("error opening file: %v", err))
+		return fmt.Errorf("error opening file: %v", err)
 	}
-	_logger := log.New(io.MultiWriter(os.Stdout, f),
-		fmt.Sprintf("%v\t", self.name), log.LstdFlags)
-	self.logger = _logger
+	self._closeFile()
+	self.opts = opts
+	self.size = 0
+	if fi, err := f.Stat(); err == nil {
+		self.size = fi.Size()
+	}
+	self.openedDay = time.Now().Format("2006-01-02")
+	self.logger = self._newLogger(io.MultiWriter(os.Stdout, &logSizeCounter{self, f}))
 	self.logfile = f
+	return nil
+}
+
+// checkLogOptions returns an error if the log file or the sink of the options
+// can not be opened.
+func checkLogOptions(opts logOptions) error {
+	switch opts.output {
+	case "syslog":
+		if _, err := opts.syslog.facility(); err != nil {
+			return fmt.Errorf("error opening syslog: %v", err)
+		}
+		return nil
+	case "journald":
+		return nil
+	}
+	f, err := os.OpenFile(opts.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	return f.Close()
 }
 
 func (self *logger) setLogLevel(level logLevel) {
+	<-self.lock
+	defer func() { self.lock <- 1 }()
 	self.loglevel = level
 }
 
+func (self *logger) logLevel() logLevel {
+	<-self.lock
+	defer func() { self.lock <- 1 }()
+	return self.loglevel
+}
+
 func (self *logger) log(level logLevel, format string, args ...interface{}) {
+	self.logWith(nil, logKindSystem, level, format, args...)
+}
+
+// logWith writes a log with the context. kind is a kind of the event like
+// "system" and "log".
+func (self *logger) logWith(ctx *logContext, kind string, level logLevel, format string, args ...interface{}) {
 	<-self.lock
 	defer func() { self.lock <- 1 }()
-	if level >= self.loglevel {
-		if len(args) > 0 {
-			self.logger.Print(level.String() + "\t" + fmt.Sprintf(format, args...))
-		} else {
-			self.logger.Print(level.String() + "\t" + format)
+	if level < self.loglevel && kind != logKindTrace {
+		return
+	}
+	if ctx == nil {
+		ctx = &logContext{}
+	}
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	line := level.String() + "\t" + msg
+	if self.opts.format == "json" {
+		record := map[string]string{
+			"time":    time.Now().Format(time.RFC3339Nano),
+			"app":     self.name,
+			"level":   level.String(),
+			"kind":    kind,
+			"message": msg,
+		}
+		if len(ctx.target) != 0 {
+			record["target"] = ctx.target
+		}
+		if len(ctx.targetType) != 0 {
+			record["target_type"] = ctx.targetType
+		}
+		data, _ := json.Marshal(record)
+		line = string(data)
+	}
+	if self._shouldRotate() {
+		self._rotate()
+	}
+	self.logger.Print(line)
+	if self.sink != nil {
+		if self.opts.format == "json" {
+			msg = line
+		}
+		if err := self.sink.write(level, ctx, kind, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "can not write logs to %s: %s\n", self.opts.output, err.Error())
 		}
 	}
 }
@@ -117,18 +267,67 @@ func (self *logger) crit(format string, args ...interface{}) {
 }
 
 func (self *logger) _closeFile() {
-	self.logfile.Close()
+	if self.logfile != nil {
+		self.logfile.Close()
+		self.logfile = nil
+	}
+	if self.sink != nil {
+		self.sink.close()
+		self.sink = nil
+	}
 }
 
 func (self *logger) closeFile() {
 	<-self.lock
 	defer func() { self.lock <- 1 }()
 	self._closeFile()
+	self._waitCompression()
 }
 
-func (self *logger) reloadFile() {
+// changeOptions reopens the log file if the options are changed. The current
+// log file is kept if the new one can not be opened.
+func (self *logger) changeOptions(opts logOptions) error {
 	<-self.lock
 	defer func() { self.lock <- 1 }()
-	self._closeFile()
-	self._openLogFile()
+	if opts == self.opts {
+		return nil
+	}
+	return self._openLogFile(opts)
+}
+
+func (self *logger) reloadFile() error {
+	<-self.lock
+	defer func() { self.lock <- 1 }()
+	return self._openLogFile(self.opts)
+}
+
+// contextLogger is a logger that attaches the context to all logs.
+type contextLogger struct {
+	*logger
+	ctx *logContext
+}
+
+func (self *contextLogger) debug(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindSystem, logLevelDebug, format, args...)
+}
+
+func (self *contextLogger) info(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindSystem, logLevelInfo, format, args...)
+}
+
+func (self *contextLogger) warn(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindSystem, logLevelWarn, format, args...)
+}
+
+func (self *contextLogger) error(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindSystem, logLevelError, format, args...)
+}
+
+func (self *contextLogger) crit(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindSystem, logLevelCrit, format, args...)
+}
+
+// trace writes a trace of the target regardless of the log level.
+func (self *contextLogger) trace(format string, args ...interface{}) {
+	self.logWith(self.ctx, logKindTrace, logLevelDebug, format, args...)
 }
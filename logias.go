@@ -13,11 +13,13 @@ const appName = "logias"
 func main() {
 	var optCfgFile string
 	var optGenSysvInit bool
+	var optCheck bool
 	flag.Usage = func() {
-		fmt.Printf(`%s [gen-sysvinit-script] -c FILE
+		fmt.Printf(`%s [gen-sysvinit-script|check] -c FILE
 Options of logias:
     -c                 : lua configuration file path.
     gen-sysvinit-script: generate init script for the Sysv.
+    check              : validate the configuration file and exit.
 `, os.Args[0])
 	}
 	if len(os.Args) > 2 {
@@ -25,6 +27,9 @@ Options of logias:
 		case "gen-sysvinit-script":
 			optGenSysvInit = true
 			os.Args = os.Args[1:]
+		case "check":
+			optCheck = true
+			os.Args = os.Args[1:]
 		}
 	}
 
@@ -42,19 +47,46 @@ Options of logias:
 		fmt.Println(genSysvInitScript(optCfgFile))
 		os.Exit(0)
 	}
+	if optCheck {
+		problems, warnings, err := checkConfig(optCfgFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can not load %s:\n\n%s\n", optCfgFile, err.Error())
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		if len(problems) != 0 {
+			for _, problem := range problems {
+				fmt.Fprintln(os.Stderr, problem)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d problem(s) found.\n", optCfgFile, len(problems))
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", optCfgFile)
+		os.Exit(0)
+	}
 
 	dp := newDispathcer(optCfgFile)
 	sigs := make(chan os.Signal, 1)
+	sigHUP := syscall.Signal(0x1)
 	sigUSR1 := syscall.Signal(0xa)
-	signal.Notify(sigs, os.Interrupt, sigUSR1)
+	sigUSR2 := syscall.Signal(0xc)
+	signal.Notify(sigs, os.Interrupt, sigHUP, sigUSR1, sigUSR2)
 	go func() {
 		for {
 			s := <-sigs
 			switch s {
 			case os.Interrupt:
 				dp.exitc <- 1
+			case sigHUP:
+				dp.reloadc <- 1
 			case sigUSR1:
-				dp.shared.logger.reloadFile()
+				if err := dp.shared.logger.reloadFile(); err != nil {
+					dp.shared.logger.error("can not reopen the log file: %s", err.Error())
+				}
+			case sigUSR2:
+				dp.debugc <- 1
 			}
 		}
 	}()
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type logRotation struct {
+	// MaxSize is a maximum size of the log file in megabytes. 0 means no
+	// size based rotation.
+	MaxSize int
+	// Daily rotates the log file every day.
+	Daily bool
+	// Generations is a number of rotated files to keep.
+	Generations int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+func (cfg *config) logRotation() *logRotation {
+	if cfg.LogRotation == nil {
+		return &logRotation{}
+	}
+	return cfg.LogRotation
+}
+
+func (lr *logRotation) enabled() bool {
+	return lr.MaxSize > 0 || lr.Daily
+}
+
+func (lr *logRotation) generations() int {
+	if lr.Generations <= 0 {
+		return 7
+	}
+	return lr.Generations
+}
+
+// logSizeCounter counts bytes written to the log file.
+type logSizeCounter struct {
+	logger *logger
+	w      io.Writer
+}
+
+func (c *logSizeCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.logger.size += int64(n)
+	return n, err
+}
+
+// _shouldRotate returns true if the log file should be rotated. The lock
+// must be held by the caller.
+func (self *logger) _shouldRotate() bool {
+	lr := &self.opts.rotation
+	if self.logfile == nil || !lr.enabled() || time.Now().Before(self.rotateRetryAt) {
+		return false
+	}
+	if lr.MaxSize > 0 && self.size >= int64(lr.MaxSize)*1024*1024 {
+		return true
+	}
+	return lr.Daily && time.Now().Format("2006-01-02") != self.openedDay
+}
+
+func rotatedLogPath(path string, i int, compress bool) string {
+	if compress {
+		return fmt.Sprintf("%s.%d.gz", path, i)
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// _rotate renames the log file to "log_file.1" and shifts older files. The
+// lock must be held by the caller, so that workers never write logs while
+// the log file is rotated. Rotated files are compressed in the background.
+func (self *logger) _rotate() {
+	path := self.opts.path
+	gens := self.opts.rotation.generations()
+	compress := self.opts.rotation.Compress
+	// files must not be shifted while the previous rotated file is being
+	// compressed.
+	self._waitCompression()
+	self._closeFile()
+
+	for _, c := range []bool{false, true} {
+		os.Remove(rotatedLogPath(path, gens, c))
+		for i := gens - 1; i >= 1; i-- {
+			if pathExists(rotatedLogPath(path, i, c)) {
+				os.Rename(rotatedLogPath(path, i, c), rotatedLogPath(path, i+1, c))
+			}
+		}
+	}
+	rotated := rotatedLogPath(path, 1, false)
+	if err := os.Rename(path, rotated); err != nil {
+		// rotations are retried later, errors are reported once until a
+		// rotation succeeds.
+		if !self.rotateFailed {
+			fmt.Fprintf(os.Stderr, "can not rotate the log file %s: %s\n", path, err.Error())
+		}
+		self.rotateFailed = true
+		self.rotateRetryAt = time.Now().Add(time.Minute)
+	} else {
+		self.rotateFailed = false
+		self.rotateRetryAt = time.Time{}
+		if compress {
+			donec := make(chan struct{})
+			self.compressing = donec
+			go func() {
+				defer close(donec)
+				if err := gzipFile(rotated, rotatedLogPath(path, 1, true)); err != nil {
+					fmt.Fprintf(os.Stderr, "can not compress the log file %s: %s\n", rotated, err.Error())
+				} else {
+					os.Remove(rotated)
+				}
+			}()
+		}
+	}
+	if err := self._openLogFile(self.opts); err != nil {
+		fmt.Fprintf(os.Stderr, "can not reopen the log file %s: %s\n", path, err.Error())
+		// logs are written only to the stdout until the log file is reopened
+		self.logger = self._newLogger(os.Stdout)
+	}
+}
+
+// _waitCompression waits for the compression of the rotated file.
+func (self *logger) _waitCompression() {
+	if self.compressing != nil {
+		<-self.compressing
+		self.compressing = nil
+	}
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/sha1"
 	"fmt"
 	"github.com/yuin/gluamapper"
 	"github.com/yuin/gopher-lua"
 	"io/ioutil"
-	"net/smtp"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"text/template"
@@ -96,6 +96,9 @@ var luaConstants = `
 	    return {
 		  type = tbl.type or target.CMD,
 		  interval = tbl.interval or 60,
+		  schedule = tbl.schedule,
+		  splay = tbl.splay,
+		  run_at_start = tbl.run_at_start,
 		  initial_state = function()
 		    local ret = {}
 		    for name, attr in pairs(tbl.attributes) do
@@ -113,8 +116,86 @@ var luaConstants = `
 		  fn = tbl.fn,
 		  parser = tbl.parser or parseltsv,
 		  filter_groups = fg,
+		  timeout = tbl.timeout,
+		  debug = tbl.debug,
+		  persist_state = tbl.persist_state,
+		  state_version = tbl.state_version,
+		  export_metrics = tbl.export_metrics,
 		}
 	  end
+
+	  nagios_states = {[0] = "NORMAL", [1] = "WARN", [2] = "ERROR", [3] = "CRIT"}
+
+	  function nagios(tbl)
+	    local parser = tbl.parser or parsenagios
+	    local svc = nil
+	    if tbl.attributes ~= nil then
+	      local t = {}
+	      for k, v in pairs(tbl) do t[k] = v; end
+	      t.parser = parser
+	      svc = service(t)
+	    end
+	    local message = tbl.message ~= nil and tostring(tbl.message) or ""
+
+	    local fg = {
+	      {
+	        action {function(state, line, obj)
+	          local st = nagios_states[obj.exit_status] or "CRIT"
+	          state.nagios.previous_state = state.nagios.current_state
+	          state.nagios.current_state = st
+	          state.nagios.exit_status = obj.exit_status
+	          state.nagios.last_message = obj.status_text or line
+	        end}
+	      }
+	    }
+	    for _, st in pairs(nagios_states) do
+	      local level = st
+	      if st == "NORMAL" then
+	        level = "INFO"
+	      end
+	      table.insert(fg, {
+	        test {function(state, line, obj)
+	          if state.nagios.current_state ~= st then
+	            return false
+	          end
+	          -- notify only once when recovered
+	          return st ~= "NORMAL" or state.nagios.previous_state ~= "NORMAL"
+	        end},
+	        notify {level=level, code=tbl.notification_code, message=message}
+	      })
+	    end
+	    if svc ~= nil then
+	      for _, g in ipairs(svc.filter_groups) do
+	        table.insert(fg, g)
+	      end
+	    end
+
+	    return {
+	      type = target.CMD,
+	      interval = tbl.interval or 60,
+	      schedule = tbl.schedule,
+	      splay = tbl.splay,
+	      run_at_start = tbl.run_at_start,
+	      timeout = tbl.timeout,
+	      with_status = true,
+	      initial_state = function()
+	        local ret = svc ~= nil and svc.initial_state() or {}
+	        ret.nagios = {
+	          exit_status = 0,
+	          current_state = "NORMAL",
+	          previous_state = "NORMAL",
+	          last_message = "",
+	        }
+	        return ret
+	      end,
+	      parser = parser,
+	      filter_groups = fg,
+	      debug = tbl.debug,
+	      persist_state = tbl.persist_state,
+	      state_version = tbl.state_version,
+	      export_metrics = tbl.export_metrics,
+	    }
+	  end
 `
 
 func callLFunc0(L *lua.LState, fn lua.LValue, args ...lua.LValue) {
@@ -273,12 +354,24 @@ func nqueueMin(L *lua.LState) int {
 
 var luaFunctions = map[string]lua.LGFunction{
 	"log":          luaLog,
+	"setloglevel":  luaSetLogLevel,
 	"template":     luaTemplate,
 	"parseltsv":    luaParseLtsv,
+	"parsenagios":  luaParseNagios,
+	"parsejson":    luaParseJson,
+	"parselogfmt":  luaParseLogfmt,
+	"parsekv":      luaParseKv,
+	"parsecsv":     luaParseCsv,
+	"parseregexp":  luaParseRegexp,
 	"threshold":    luaThreshold,
 	"downtimefile": luaDowntimeFile,
 	"isindowntime": luaIsInDowntime,
+	"currentpath":  luaCurrentPath,
 	"mail":         luaMail,
+	"webhook":      luaWebhook,
+	"syslog":       luaSyslog,
+	"ackalert":     luaAckAlert,
+	"resolvealert": luaResolveAlert,
 }
 
 func luaGetAttr(obj lua.LValue, names ...string) lua.LValue {
@@ -289,6 +382,22 @@ func luaGetAttr(obj lua.LValue, names ...string) lua.LValue {
 	return cur
 }
 
+// luaGetPath returns a value of the tbl referred by the dotted name like
+// "a.b.c". A key that contains dots takes priority over nested tables.
+func luaGetPath(tbl *lua.LTable, name string) lua.LValue {
+	if lv := tbl.RawGetString(name); lv != lua.LNil {
+		return lv
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return lua.LNil
+	}
+	if child, ok := tbl.RawGetString(parts[0]).(*lua.LTable); ok {
+		return luaGetPath(child, parts[1])
+	}
+	return lua.LNil
+}
+
 func luaMustGetTableAttr(obj lua.LValue, names ...string) *lua.LTable {
 	return luaGetAttr(obj, names...).(*lua.LTable)
 }
@@ -313,16 +422,182 @@ func luaToString(L *lua.LState, obj lua.LValue) string {
 	return strings.Join(buf, "")
 }
 
+// luaFingerprint returns a digest of the given value. Values that are built
+// from the same definition have the same fingerprint even if they belong to
+// different LStates.
+func luaFingerprint(lv lua.LValue) string {
+	var buf bytes.Buffer
+	writeLuaFingerprint(&buf, lv, map[interface{}]int{})
+	return fmt.Sprintf("%x", sha1.Sum(buf.Bytes()))
+}
+
+func writeLuaFingerprint(buf *bytes.Buffer, lv lua.LValue, seen map[interface{}]int) {
+	switch v := lv.(type) {
+	case *lua.LTable:
+		if i, ok := seen[v]; ok {
+			fmt.Fprintf(buf, "@%d;", i)
+			return
+		}
+		seen[v] = len(seen)
+		// values are written in the order of keys, so that references to
+		// seen values are numbered regardless of the iteration order.
+		keys := []string{}
+		values := map[string]lua.LValue{}
+		v.ForEach(func(key, value lua.LValue) {
+			var kbuf bytes.Buffer
+			writeLuaFingerprint(&kbuf, key, seen)
+			keys = append(keys, kbuf.String())
+			values[kbuf.String()] = value
+		})
+		sort.Strings(keys)
+		buf.WriteString("{")
+		for _, key := range keys {
+			buf.WriteString(key)
+			buf.WriteString("=")
+			writeLuaFingerprint(buf, values[key], seen)
+			buf.WriteString(",")
+		}
+		buf.WriteString("}")
+	case *lua.LFunction:
+		if i, ok := seen[v]; ok {
+			fmt.Fprintf(buf, "@%d;", i)
+			return
+		}
+		seen[v] = len(seen)
+		if v.IsG {
+			fmt.Fprintf(buf, "G%x(", reflect.ValueOf(v.GFunction).Pointer())
+		} else {
+			buf.WriteString("F")
+			writeProtoFingerprint(buf, v.Proto)
+			buf.WriteString("(")
+		}
+		for _, uv := range v.Upvalues {
+			writeLuaFingerprint(buf, uv.Value(), seen)
+			buf.WriteString(",")
+		}
+		buf.WriteString(")")
+		if !v.IsG && v.Env != nil {
+			// globals(i.e. helper functions) referenced by the function
+			// are a part of the definition.
+			names := map[string]bool{}
+			protoGlobalNames(v.Proto, names)
+			sorted := []string{}
+			for name, _ := range names {
+				sorted = append(sorted, name)
+			}
+			sort.Strings(sorted)
+			buf.WriteString("<")
+			for _, name := range sorted {
+				fmt.Fprintf(buf, "%s=", name)
+				writeLuaFingerprint(buf, v.Env.RawGetString(name), seen)
+			}
+			buf.WriteString(">")
+		}
+	case *lua.LUserData:
+		if st, ok := v.Value.(fmt.Stringer); ok {
+			fmt.Fprintf(buf, "U%T:%q;", v.Value, st.String())
+		} else {
+			fmt.Fprintf(buf, "U%T;", v.Value)
+		}
+	default:
+		fmt.Fprintf(buf, "%s:%q;", lv.Type().String(), lv.String())
+	}
+}
+
+func writeProtoFingerprint(buf *bytes.Buffer, proto *lua.FunctionProto) {
+	// line numbers are ignored so that moving a definition around the
+	// configuration file does not change its fingerprint.
+	fmt.Fprintf(buf, "[%d,%d,%v,", proto.NumParameters, proto.IsVarArg, proto.Code)
+	for _, c := range proto.Constants {
+		fmt.Fprintf(buf, "%s:%q,", c.Type().String(), c.String())
+	}
+	for _, p := range proto.FunctionPrototypes {
+		writeProtoFingerprint(buf, p)
+	}
+	buf.WriteString("]")
+}
+
+// protoGlobalNames collects names of globals that are read by the proto and
+// its nested protos.
+func protoGlobalNames(proto *lua.FunctionProto, names map[string]bool) {
+	for _, inst := range proto.Code {
+		// see opGetOpCode and opGetArgBx of the gopher-lua
+		if int(inst>>26) != lua.OP_GETGLOBAL {
+			continue
+		}
+		if bx := int(inst & 0x3ffff); bx < len(proto.Constants) {
+			if name, ok := proto.Constants[bx].(lua.LString); ok {
+				names[string(name)] = true
+			}
+		}
+	}
+	for _, p := range proto.FunctionPrototypes {
+		protoGlobalNames(p, names)
+	}
+}
+
+// luaCopyValue copies the given value into the L. Functions and
+// userdata except nqueues can not be copied, they are replaced with nil.
+func luaCopyValue(L *lua.LState, lv lua.LValue) lua.LValue {
+	return copyLuaValue(L, lv, map[*lua.LTable]*lua.LTable{})
+}
+
+func copyLuaValue(L *lua.LState, lv lua.LValue, seen map[*lua.LTable]*lua.LTable) lua.LValue {
+	switch v := lv.(type) {
+	case lua.LString, lua.LNumber, lua.LBool:
+		return v
+	case *lua.LTable:
+		if t, ok := seen[v]; ok {
+			return t
+		}
+		tbl := L.NewTable()
+		seen[v] = tbl
+		v.ForEach(func(key, value lua.LValue) {
+			k := copyLuaValue(L, key, seen)
+			if k == lua.LNil {
+				return
+			}
+			tbl.RawSet(k, copyLuaValue(L, value, seen))
+		})
+		return tbl
+	case *lua.LUserData:
+		if q, ok := v.Value.(*nqueue); ok {
+			d := make([]lua.LNumber, len(q.d))
+			copy(d, q.d)
+			ud := L.NewUserData()
+			ud.Value = &nqueue{q.capa, d}
+			L.SetMetatable(ud, L.GetTypeMetatable(nqueueName))
+			return ud
+		}
+	}
+	return lua.LNil
+}
+
 func goThread(L *lua.LState) *thread {
 	return L.Get(lua.UpvalueIndex(1)).(*lua.LUserData).Value.(*thread)
 }
 
 func luaLog(L *lua.LState) int {
 	th := goThread(L)
-	th.shared.logger.log(logLevelOf(L.CheckString(1)), L.CheckString(2))
+	th.shared.logger.logWith(&th.logCtx, th.logKind, logLevelOf(L.CheckString(1)), L.CheckString(2))
 	return 0
 }
 
+// luaSetLogLevel changes the global log level and returns the previous one.
+func luaSetLogLevel(L *lua.LState) int {
+	th := goThread(L)
+	level := logLevelOf(L.CheckString(1))
+	if level == logLevelUnknown {
+		L.ArgError(1, "unknown log level")
+		return 0
+	}
+	old := th.shared.logger.logLevel()
+	th.shared.logger.setLogLevel(level)
+	th.shared.logger.info("log level changed from %s to %s.", old.String(), level.String())
+	L.Push(lua.LString(old.String()))
+	return 1
+}
+
 func luaTemplate(L *lua.LState) int {
 	tpl, err := template.New("").Parse(L.CheckString(1))
 	if err != nil {
@@ -379,7 +654,7 @@ func _luaThreshold(L *lua.LState) int {
 	}
 
 	if !lua.LVAsBool(obj.RawGetString(attrname + "__thput__")) {
-		callLFunc0(L, L.GetField(nq, "put"), nq, lua.LVAsNumber(obj.RawGetString(attrname)))
+		callLFunc0(L, L.GetField(nq, "put"), nq, lua.LVAsNumber(luaGetPath(obj, attrname)))
 		obj.RawSetString(attrname+"__thput__", lua.LTrue)
 	}
 
@@ -523,78 +798,8 @@ func luaIsInDowntime(L *lua.LState) int {
 	return 1
 }
 
-func luaMail(L *lua.LState) int {
-	tbl := L.CheckTable(1)
-	luser := tbl.RawGetString("user")
-	if luser == lua.LNil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("user can not be nil"))
-		return 2
-	}
-	user := lua.LVAsString(luser)
-	password := lua.LVAsString(tbl.RawGetString("password"))
-
-	lauthhost := tbl.RawGetString("authhost")
-	if lauthhost == lua.LNil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("authhost can not be nil"))
-		return 2
-	}
-	authhost := lua.LVAsString(lauthhost)
-
-	lhost := tbl.RawGetString("host")
-	if lhost == lua.LNil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("host can not be nil"))
-		return 2
-	}
-	host := lua.LVAsString(lhost)
-
-	lfrom := tbl.RawGetString("from")
-	if lfrom == lua.LNil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("from can not be nil"))
-		return 2
-	}
-	from := lua.LVAsString(lfrom)
-
-	ltos := tbl.RawGetString("to")
-	if ltos == lua.LNil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("to can not be nil"))
-		return 2
-	}
-	tos := []string{}
-	if ltos.Type() == lua.LTString {
-		tos = append(tos, lua.LVAsString(ltos))
-	} else {
-		ltos.(*lua.LTable).ForEach(func(key, value lua.LValue) {
-			tos = append(tos, lua.LVAsString(value))
-		})
-	}
-
-	subject := lua.LVAsString(tbl.RawGetString("subject"))
-	body := lua.LVAsString(tbl.RawGetString("body"))
-
-	auth := smtp.PlainAuth("", user, password, authhost)
-	message := []string{}
-	for k, v := range map[string]string{
-		"From":                      from,
-		"To":                        strings.Join(tos, ", "),
-		"MIME-Version":              "1.0",
-		"Content-Type":              "text/plain; charset=\"utf-8\"",
-		"Content-Transfer-Encoding": "base64",
-	} {
-		message = append(message, fmt.Sprintf("%s: %s\r\n", k, v))
-	}
-	message = append(message, encodeSubject(subject))
-	message = append(message, "\r\n")
-	message = append(message, add76crlf(base64.StdEncoding.EncodeToString([]byte(body))))
-	if err := smtp.SendMail(host, auth, from, tos, []byte(strings.Join(message, ""))); err != nil {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString(err.Error()))
-		return 2
-	}
-	L.Push(lua.LTrue)
+func luaCurrentPath(L *lua.LState) int {
+	th := goThread(L)
+	L.Push(lua.LString(th.currentPath))
 	return 1
 }
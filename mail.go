@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxMatchedLines is a maximum number of matched lines kept for mail
+// attachments.
+const maxMatchedLines = 100
+
+type mailAttachment struct {
+	filename    string
+	contentType string
+	content     []byte
+}
+
+type mailMessage struct {
+	from        *mail.Address
+	to          []*mail.Address
+	cc          []*mail.Address
+	bcc         []*mail.Address
+	replyTo     []*mail.Address
+	subject     string
+	text        string
+	html        string
+	attachments []*mailAttachment
+}
+
+func luaMailAddresses(lv lua.LValue) ([]*mail.Address, error) {
+	values := []string{}
+	switch v := lv.(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		v.ForEach(func(key, value lua.LValue) {
+			values = append(values, lua.LVAsString(value))
+		})
+	default:
+		values = append(values, lua.LVAsString(lv))
+	}
+	ret := []*mail.Address{}
+	for _, value := range values {
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address '%s': %s", value, err.Error())
+		}
+		ret = append(ret, addr)
+	}
+	return ret, nil
+}
+
+func joinMailAddresses(addrs []*mail.Address) string {
+	values := []string{}
+	for _, addr := range addrs {
+		// String() encodes names by the RFC 2047
+		values = append(values, addr.String())
+	}
+	return strings.Join(values, ", ")
+}
+
+func newMessageId() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), buf, hostname)
+}
+
+func writeBase64Part(w *multipart.Writer, header textproto.MIMEHeader, data []byte) error {
+	header.Set("Content-Transfer-Encoding", "base64")
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write([]byte(add76crlf(base64.StdEncoding.EncodeToString(data))))
+	return err
+}
+
+// writeBody writes the body of the message. A text and a html are sent as a
+// multipart/alternative part, attachments are sent as a multipart/mixed
+// message.
+func (m *mailMessage) writeBody(buf *bytes.Buffer) error {
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Type", "text/plain; charset=\"utf-8\"")
+
+	var body bytes.Buffer
+	contentType := ""
+	if len(m.html) == 0 {
+		contentType = textHeader.Get("Content-Type")
+		body.WriteString(add76crlf(base64.StdEncoding.EncodeToString([]byte(m.text))))
+	} else {
+		w := multipart.NewWriter(&body)
+		if err := writeBase64Part(w, textHeader, []byte(m.text)); err != nil {
+			return err
+		}
+		htmlHeader := textproto.MIMEHeader{}
+		htmlHeader.Set("Content-Type", "text/html; charset=\"utf-8\"")
+		if err := writeBase64Part(w, htmlHeader, []byte(m.html)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		contentType = "multipart/alternative; boundary=" + w.Boundary()
+	}
+
+	if len(m.attachments) == 0 {
+		if len(m.html) == 0 {
+			buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+		}
+		fmt.Fprintf(buf, "Content-Type: %s\r\n\r\n", contentType)
+		buf.Write(body.Bytes())
+		return nil
+	}
+
+	var mixed bytes.Buffer
+	w := multipart.NewWriter(&mixed)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	if len(m.html) == 0 {
+		header.Set("Content-Transfer-Encoding", "base64")
+	}
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	pw.Write(body.Bytes())
+	for _, a := range m.attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", a.contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.filename}))
+		if err := writeBase64Part(w, header, a.content); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	buf.Write(mixed.Bytes())
+	return nil
+}
+
+func (m *mailMessage) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	headers := [][]string{
+		{"From", m.from.String()},
+		{"To", joinMailAddresses(m.to)},
+	}
+	if len(m.cc) != 0 {
+		headers = append(headers, []string{"Cc", joinMailAddresses(m.cc)})
+	}
+	if len(m.replyTo) != 0 {
+		headers = append(headers, []string{"Reply-To", joinMailAddresses(m.replyTo)})
+	}
+	headers = append(headers,
+		[]string{"Date", time.Now().Format(time.RFC1123Z)},
+		[]string{"Message-ID", newMessageId()},
+		[]string{"MIME-Version", "1.0"},
+	)
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString(encodeSubject(m.subject))
+	if err := m.writeBody(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *mailMessage) recipients() []string {
+	ret := []string{}
+	for _, addrs := range [][]*mail.Address{m.to, m.cc, m.bcc} {
+		for _, addr := range addrs {
+			ret = append(ret, addr.Address)
+		}
+	}
+	return ret
+}
+
+// sendMail sends the message. tlsMode is one of the following:
+//
+//   - "": STARTTLS is used if the server supports it.
+//   - "none": STARTTLS is never used.
+//   - "starttls": STARTTLS is required.
+//   - "tls": An implicit TLS connection is used.
+func sendMail(host, tlsMode string, tlsConfig *tls.Config, auth smtp.Auth, timeout time.Duration, from string, rcpts []string, msg []byte) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, tlsConfig.ServerName)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if tlsMode == "" || tlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if tlsMode == "starttls" {
+			return fmt.Errorf("%s does not support STARTTLS", host)
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not support AUTH", host)
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func luaMailError(L *lua.LState, format string, args ...interface{}) int {
+	L.Push(lua.LFalse)
+	L.Push(lua.LString(fmt.Sprintf(format, args...)))
+	return 2
+}
+
+func luaMail(L *lua.LState) int {
+	th := goThread(L)
+	tbl := L.CheckTable(1)
+	lhost := tbl.RawGetString("host")
+	if lhost == lua.LNil {
+		return luaMailError(L, "host can not be nil")
+	}
+	host := lua.LVAsString(lhost)
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return luaMailError(L, "invalid host '%s': %s", host, err.Error())
+	}
+
+	m := &mailMessage{}
+	lfrom := tbl.RawGetString("from")
+	if lfrom == lua.LNil {
+		return luaMailError(L, "from can not be nil")
+	}
+	if m.from, err = mail.ParseAddress(lua.LVAsString(lfrom)); err != nil {
+		return luaMailError(L, "invalid address '%s': %s", lua.LVAsString(lfrom), err.Error())
+	}
+	if tbl.RawGetString("to") == lua.LNil {
+		return luaMailError(L, "to can not be nil")
+	}
+	for name, addrs := range map[string]*[]*mail.Address{"to": &m.to, "cc": &m.cc, "bcc": &m.bcc, "reply_to": &m.replyTo} {
+		if *addrs, err = luaMailAddresses(tbl.RawGetString(name)); err != nil {
+			return luaMailError(L, "%s: %s", name, err.Error())
+		}
+	}
+	m.subject = lua.LVAsString(tbl.RawGetString("subject"))
+	m.text = lua.LVAsString(tbl.RawGetString("body"))
+	m.html = lua.LVAsString(tbl.RawGetString("html"))
+
+	if n := int(lua.LVAsNumber(tbl.RawGetString("attach_lines"))); n > 0 && len(th.matchedLines) != 0 {
+		lines := th.matchedLines
+		if len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		m.attachments = append(m.attachments, &mailAttachment{
+			filename:    "lines.txt",
+			contentType: "text/plain; charset=\"utf-8\"",
+			content:     []byte(strings.Join(lines, "\n") + "\n"),
+		})
+	}
+	if lattachments, ok := tbl.RawGetString("attachments").(*lua.LTable); ok {
+		var aerr error
+		lattachments.ForEach(func(key, value lua.LValue) {
+			la, ok := value.(*lua.LTable)
+			if !ok {
+				aerr = fmt.Errorf("attachments must be a list of tables")
+				return
+			}
+			a := &mailAttachment{
+				filename:    lua.LVAsString(la.RawGetString("filename")),
+				contentType: lua.LVAsString(la.RawGetString("content_type")),
+				content:     []byte(lua.LVAsString(la.RawGetString("content"))),
+			}
+			if len(a.filename) == 0 {
+				aerr = fmt.Errorf("filename of attachments can not be empty")
+			}
+			if len(a.contentType) == 0 {
+				a.contentType = "application/octet-stream"
+			}
+			m.attachments = append(m.attachments, a)
+		})
+		if aerr != nil {
+			return luaMailError(L, "%s", aerr.Error())
+		}
+	}
+
+	var auth smtp.Auth
+	if luser := tbl.RawGetString("user"); luser != lua.LNil {
+		authhost := hostname
+		if lauthhost := tbl.RawGetString("authhost"); lauthhost != lua.LNil {
+			authhost = lua.LVAsString(lauthhost)
+			if h, _, err := net.SplitHostPort(authhost); err == nil {
+				authhost = h
+			}
+		}
+		auth = smtp.PlainAuth("", lua.LVAsString(luser), lua.LVAsString(tbl.RawGetString("password")), authhost)
+	}
+	tlsMode := lua.LVAsString(tbl.RawGetString("tls"))
+	switch tlsMode {
+	case "", "none", "starttls", "tls":
+	default:
+		return luaMailError(L, "unknown tls mode '%s'", tlsMode)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: lua.LVAsBool(tbl.RawGetString("insecure_skip_verify")),
+	}
+	timeout := 30 * time.Second
+	if lv, ok := tbl.RawGetString("timeout").(lua.LNumber); ok {
+		timeout = time.Duration(lv) * time.Second
+	}
+
+	msg, err := m.bytes()
+	if err != nil {
+		return luaMailError(L, "%s", err.Error())
+	}
+	if err := sendMail(host, tlsMode, tlsConfig, auth, timeout, m.from.Address, m.recipients(), msg); err != nil {
+		return luaMailError(L, "%s", err.Error())
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
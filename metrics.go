@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metricDef struct {
+	typ  string
+	help string
+}
+
+var metricDefs = map[string]*metricDef{
+	"logias_lines_read_total":               {"counter", "Number of lines read from files."},
+	"logias_bytes_read_total":               {"counter", "Number of bytes read from files."},
+	"logias_parser_errors_total":            {"counter", "Number of errors raised by parsers."},
+	"logias_filter_group_matches_total":     {"counter", "Number of lines that passed all filters of the group."},
+	"logias_notifications_total":            {"counter", "Number of notifications sent to notifiers."},
+	"logias_command_runs_total":             {"counter", "Number of command runs."},
+	"logias_command_failures_total":         {"counter", "Number of commands that failed, timed out or exited with non-zero statuses."},
+	"logias_command_duration_seconds_total": {"counter", "Total duration of command runs in seconds."},
+	"logias_command_last_duration_seconds":  {"gauge", "Duration of the last command run in seconds."},
+	"logias_file_lag_bytes":                 {"gauge", "Size of the file minus the read position."},
+	"logias_exported_value":                 {"gauge", "Numeric fields of parsed objects exported by export_metrics."},
+	"logias_target_failed":                  {"gauge", "1 if the target failed after consecutive crashes."},
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+}
+
+// metricsRegistry holds metrics of all targets. The first label of every
+// series is "target".
+type metricsRegistry struct {
+	sync.Mutex
+	series map[string]map[string]*metricSeries
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{series: map[string]map[string]*metricSeries{}}
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatLabels(labels []string) string {
+	parts := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabelValue(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (mr *metricsRegistry) get(name string, labels []string) *metricSeries {
+	m, ok := mr.series[name]
+	if !ok {
+		m = map[string]*metricSeries{}
+		mr.series[name] = m
+	}
+	key := formatLabels(labels)
+	s, ok := m[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		m[key] = s
+	}
+	return s
+}
+
+// add adds the value to the counter. labels are pairs of names and values.
+func (mr *metricsRegistry) add(name string, value float64, labels ...string) {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.get(name, labels).value += value
+}
+
+// set sets the value to the gauge.
+func (mr *metricsRegistry) set(name string, value float64, labels ...string) {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.get(name, labels).value = value
+}
+
+func (mr *metricsRegistry) remove(name string, labels ...string) {
+	mr.Lock()
+	defer mr.Unlock()
+	if m, ok := mr.series[name]; ok {
+		delete(m, formatLabels(labels))
+	}
+}
+
+// removeTarget removes all series of the target.
+func (mr *metricsRegistry) removeTarget(target string) {
+	mr.Lock()
+	defer mr.Unlock()
+	for _, m := range mr.series {
+		for key, s := range m {
+			if len(s.labels) > 1 && s.labels[0] == "target" && s.labels[1] == target {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// write writes metrics in the Prometheus text format.
+func (mr *metricsRegistry) write(w io.Writer) {
+	mr.Lock()
+	defer mr.Unlock()
+	names := []string{}
+	for name, _ := range mr.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := mr.series[name]
+		if len(m) == 0 {
+			continue
+		}
+		if def, ok := metricDefs[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, def.help, name, def.typ)
+		}
+		keys := []string{}
+		for key, _ := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %v\n", name, key, m[key].value)
+		}
+	}
+}
+
+// exportMetrics exports numeric fields of the parsed object as gauges.
+// export_metrics is true(all numeric fields) or a list of field names.
+// Dotted names refer fields of nested tables.
+func (wk *worker) exportMetrics(obj lua.LValue) {
+	tbl, ok := obj.(*lua.LTable)
+	if !ok || wk.target.ExportMetrics == nil {
+		return
+	}
+	fields := map[string]lua.LValue{}
+	switch v := wk.target.ExportMetrics.(type) {
+	case bool:
+		if !v {
+			return
+		}
+		tbl.ForEach(func(key, value lua.LValue) {
+			if _, ok := key.(lua.LString); ok {
+				fields[key.String()] = value
+			}
+		})
+	case []interface{}:
+		for _, name := range v {
+			fields[fmt.Sprint(name)] = luaGetPath(tbl, fmt.Sprint(name))
+		}
+	}
+	for name, value := range fields {
+		switch lv := value.(type) {
+		case lua.LNumber:
+			wk.shared.metrics.set("logias_exported_value", float64(lv), "target", wk.target.Path, "field", name)
+		case lua.LString:
+			if n, err := parseNumber(string(lv)); err == nil {
+				wk.shared.metrics.set("logias_exported_value", n, "target", wk.target.Path, "field", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+)
+
+type multiline struct {
+	Start        string
+	Continuation string
+	MaxLines     int
+	FlushTimeout int
+
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+}
+
+const defaultMultilineMaxLines = 500
+
+func (ml *multiline) init() error {
+	if len(ml.Start) != 0 {
+		re, err := regexp.Compile(ml.Start)
+		if err != nil {
+			return err
+		}
+		ml.start = re
+	}
+	if len(ml.Continuation) != 0 {
+		re, err := regexp.Compile(ml.Continuation)
+		if err != nil {
+			return err
+		}
+		ml.continuation = re
+	}
+	return nil
+}
+
+// isStart returns true if the line begins a new record.
+func (ml *multiline) isStart(line string) bool {
+	if ml.start != nil && ml.start.MatchString(line) {
+		return true
+	}
+	if ml.continuation != nil {
+		return !ml.continuation.MatchString(line)
+	}
+	return ml.start == nil
+}
+
+func (ml *multiline) maxLines() int {
+	if ml.MaxLines <= 0 {
+		return defaultMultilineMaxLines
+	}
+	return intMin(ml.MaxLines, fileMaxRead)
+}
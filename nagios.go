@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/yuin/gopher-lua"
+	"strings"
+)
+
+type perfdata struct {
+	label string
+	value string
+	uom   string
+	warn  string
+	crit  string
+	min   string
+	max   string
+}
+
+// parsePerfdata parses Nagios plugin performance data like
+// "'label'=value[UOM];[warn];[crit];[min];[max] ...".
+func parsePerfdata(s string) []*perfdata {
+	ret := []*perfdata{}
+	s = strings.TrimSpace(s)
+	for len(s) > 0 {
+		var label string
+		if s[0] == '\'' {
+			end := strings.Index(s[1:], "'=")
+			if end < 0 {
+				break
+			}
+			label = strings.Replace(s[1:end+1], "''", "'", -1)
+			s = s[end+3:]
+		} else {
+			end := strings.Index(s, "=")
+			if end < 0 {
+				break
+			}
+			label = s[0:end]
+			s = s[end+1:]
+		}
+		end := strings.IndexAny(s, " \t")
+		data := s
+		if end < 0 {
+			s = ""
+		} else {
+			data = s[0:end]
+			s = strings.TrimSpace(s[end:])
+		}
+		parts := strings.Split(data, ";")
+		for len(parts) < 5 {
+			parts = append(parts, "")
+		}
+		pd := &perfdata{label: strings.TrimSpace(label), warn: parts[1], crit: parts[2], min: parts[3], max: parts[4]}
+		i := strings.IndexFunc(parts[0], func(r rune) bool {
+			return !(r >= '0' && r <= '9' || r == '.' || r == '-' || r == '+' || r == 'e' || r == 'E')
+		})
+		if i < 0 {
+			pd.value = parts[0]
+		} else {
+			pd.value = parts[0][0:i]
+			pd.uom = parts[0][i:]
+		}
+		ret = append(ret, pd)
+	}
+	return ret
+}
+
+func perfdataValue(v string) lua.LValue {
+	if len(v) == 0 {
+		return lua.LNil
+	}
+	if num, err := parseNumber(v); err == nil {
+		return lua.LNumber(num)
+	}
+	return lua.LString(v)
+}
+
+func luaParseNagios(L *lua.LState) int {
+	output := L.CheckString(1)
+	ret := L.NewTable()
+	lperfdata := L.NewTable()
+
+	lines := strings.Split(output, "\n")
+	status := lines[0]
+	perf := []string{}
+	if i := strings.Index(status, "|"); i > -1 {
+		perf = append(perf, status[i+1:])
+		status = status[0:i]
+	}
+	longText := []string{}
+	inPerf := false
+	for _, line := range lines[1:] {
+		if inPerf {
+			perf = append(perf, line)
+			continue
+		}
+		if i := strings.Index(line, "|"); i > -1 {
+			longText = append(longText, line[0:i])
+			perf = append(perf, line[i+1:])
+			inPerf = true
+			continue
+		}
+		longText = append(longText, line)
+	}
+	ret.RawSetString("status_text", lua.LString(strings.TrimSpace(status)))
+	ret.RawSetString("long_text", lua.LString(strings.TrimSpace(strings.Join(longText, "\n"))))
+
+	for _, pd := range parsePerfdata(strings.Join(perf, " ")) {
+		value := perfdataValue(pd.value)
+		lpd := L.NewTable()
+		lpd.RawSetString("value", value)
+		lpd.RawSetString("uom", lua.LString(pd.uom))
+		lpd.RawSetString("warn", perfdataValue(pd.warn))
+		lpd.RawSetString("crit", perfdataValue(pd.crit))
+		lpd.RawSetString("min", perfdataValue(pd.min))
+		lpd.RawSetString("max", perfdataValue(pd.max))
+		lperfdata.RawSetString(pd.label, lpd)
+		// numeric values are also set to the parsed object, so that
+		// threshold() can refer them by label names.
+		if value.Type() == lua.LTNumber && ret.RawGetString(pd.label) == lua.LNil {
+			ret.RawSetString(pd.label, value)
+		}
+	}
+	ret.RawSetString("perfdata", lperfdata)
+	L.Push(ret)
+	return 1
+}
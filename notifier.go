@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type notifiers struct {
@@ -9,3 +14,172 @@ type notifiers struct {
 	Level   map[string]*lua.LFunction
 	Code    map[string]*lua.LFunction
 }
+
+// notifierOf returns a name(default, level.X or code.X) and a function of
+// the notifier that is determined from the code or the level.
+func (cfg *config) notifierOf(level, code string) (string, *lua.LFunction) {
+	if len(code) != 0 {
+		if f, ok := cfg.Notifiers.Code[code]; ok {
+			return "code." + code, f
+		}
+	}
+	if len(level) != 0 {
+		if f, ok := cfg.Notifiers.Level[level]; ok {
+			return "level." + level, f
+		}
+	}
+	return "default", cfg.Notifiers.Default
+}
+
+// notifierByName returns a function of the notifier named by notifierOf.
+func (cfg *config) notifierByName(name string) *lua.LFunction {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 2 {
+		switch parts[0] {
+		case "code":
+			if f, ok := cfg.Notifiers.Code[parts[1]]; ok {
+				return f
+			}
+		case "level":
+			if f, ok := cfg.Notifiers.Level[parts[1]]; ok {
+				return f
+			}
+		}
+	}
+	return cfg.Notifiers.Default
+}
+
+type rateLimit struct {
+	// Count is a maximum number of notifications in the Period. nil means
+	// the default and 0 means all notifications are digested.
+	Count *int
+	// Period is a length of the rate limit window in seconds.
+	Period int
+	// Digest is an interval in seconds of aggregated notifications.
+	Digest int
+}
+
+func (rl *rateLimit) count() int {
+	if rl.Count == nil {
+		return 10
+	}
+	return *rl.Count
+}
+
+func (rl *rateLimit) period() time.Duration {
+	if rl.Period <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(rl.Period) * time.Second
+}
+
+func (rl *rateLimit) digest() time.Duration {
+	if rl.Digest <= 0 {
+		return rl.period()
+	}
+	return time.Duration(rl.Digest) * time.Second
+}
+
+// notificationBatch is a set of notifications over the rate limit.
+type notificationBatch struct {
+	name         string
+	since        time.Time
+	count        int
+	level        string
+	code         string
+	firstMessage string
+	lastMessage  string
+	targets      map[string]int
+}
+
+func (b *notificationBatch) message() string {
+	return fmt.Sprintf("%d notifications were suppressed (first: %s, last: %s)", b.count, b.firstMessage, b.lastMessage)
+}
+
+func (b *notificationBatch) toLua(L *lua.LState) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString("count", lua.LNumber(b.count))
+	tbl.RawSetString("since", lua.LNumber(b.since.Unix()))
+	tbl.RawSetString("first_message", lua.LString(b.firstMessage))
+	tbl.RawSetString("last_message", lua.LString(b.lastMessage))
+	targets := L.NewTable()
+	for target, count := range b.targets {
+		targets.RawSetString(target, lua.LNumber(count))
+	}
+	tbl.RawSetString("targets", targets)
+	return tbl
+}
+
+type limitState struct {
+	windowStart time.Time
+	sent        int
+	batch       *notificationBatch
+}
+
+// notifierLimiter limits rates of notifiers. It is shared by workers, so
+// limits are applied to notifications from all targets.
+type notifierLimiter struct {
+	sync.Mutex
+	states map[string]*limitState
+}
+
+func newNotifierLimiter() *notifierLimiter {
+	return &notifierLimiter{states: map[string]*limitState{}}
+}
+
+// allow returns true if the notification can be sent. Otherwise the
+// notification is added to the batch of the notifier.
+func (nl *notifierLimiter) allow(name string, rl *rateLimit, target, level, code, message string) bool {
+	nl.Lock()
+	defer nl.Unlock()
+	now := time.Now()
+	st, ok := nl.states[name]
+	if !ok {
+		st = &limitState{windowStart: now}
+		nl.states[name] = st
+	}
+	if now.Sub(st.windowStart) >= rl.period() {
+		st.windowStart = now
+		st.sent = 0
+	}
+	if st.sent < rl.count() {
+		st.sent++
+		return true
+	}
+	b := st.batch
+	if b == nil {
+		b = &notificationBatch{name: name, since: now, firstMessage: message, targets: map[string]int{}}
+		st.batch = b
+	}
+	b.count++
+	b.lastMessage = message
+	b.targets[target]++
+	if logLevelOf(level) >= logLevelOf(b.level) {
+		b.level = level
+	}
+	if len(code) != 0 {
+		b.code = code
+	}
+	return false
+}
+
+// due returns batches that should be delivered. Batches of notifiers that
+// have no rate limits are delivered immediately.
+func (nl *notifierLimiter) due(limits map[string]*rateLimit) []*notificationBatch {
+	nl.Lock()
+	defer nl.Unlock()
+	now := time.Now()
+	ret := []*notificationBatch{}
+	for name, st := range nl.states {
+		if st.batch == nil {
+			continue
+		}
+		if rl, ok := limits[name]; ok && now.Sub(st.batch.since) < rl.digest() {
+			continue
+		}
+		ret = append(ret, st.batch)
+		st.batch = nil
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+	"strings"
+)
+
+func luaStringOrNumber(s string) lua.LValue {
+	if num, err := parseNumber(s); err == nil {
+		return lua.LNumber(num)
+	}
+	return lua.LString(s)
+}
+
+func jsonToLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, item := range v {
+			tbl.Append(jsonToLua(L, item))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for key, item := range v {
+			tbl.RawSetString(key, jsonToLua(L, item))
+		}
+		return tbl
+	}
+	return lua.LNil
+}
+
+func luaParseJson(L *lua.LState) int {
+	var value interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+		L.RaiseError("invalid json: %s", err.Error())
+		return 0
+	}
+	L.Push(jsonToLua(L, value))
+	return 1
+}
+
+func luaParseLogfmt(L *lua.LState) int {
+	line := L.CheckString(1)
+	ret := L.NewTable()
+	i := 0
+	for i < len(line) {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		key := line[start:i]
+		if i >= len(line) || line[i] != '=' {
+			if len(key) != 0 {
+				ret.RawSetString(key, lua.LTrue)
+			}
+			continue
+		}
+		i++ // skip '='
+		if i < len(line) && line[i] == '"' {
+			var buf []byte
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						buf = append(buf, '\n')
+					case 't':
+						buf = append(buf, '\t')
+					default:
+						buf = append(buf, line[i])
+					}
+				} else {
+					buf = append(buf, line[i])
+				}
+				i++
+			}
+			i++ // skip '"'
+			if len(key) != 0 {
+				ret.RawSetString(key, lua.LString(string(buf)))
+			}
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		if len(key) != 0 {
+			ret.RawSetString(key, luaStringOrNumber(line[start:i]))
+		}
+	}
+	L.Push(ret)
+	return 1
+}
+
+func _luaParseKv(L *lua.LState) int {
+	sep := L.Get(lua.UpvalueIndex(1)).String()
+	kvsep := L.Get(lua.UpvalueIndex(2)).String()
+	line := L.CheckString(1)
+	var pairs []string
+	if strings.TrimSpace(sep) == "" {
+		pairs = strings.Fields(line)
+	} else {
+		pairs = strings.Split(line, sep)
+	}
+	ret := L.NewTable()
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, kvsep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			ret.RawSetString(key, lua.LString(value[1:len(value)-1]))
+		} else {
+			ret.RawSetString(key, luaStringOrNumber(value))
+		}
+	}
+	L.Push(ret)
+	return 1
+}
+
+func luaParseKv(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	sep := lua.LString(" ")
+	if lv := tbl.RawGetString("sep"); lv != lua.LNil {
+		sep = lua.LString(lv.String())
+	}
+	kvsep := lua.LString("=")
+	if lv := tbl.RawGetString("kvsep"); lv != lua.LNil {
+		kvsep = lua.LString(lv.String())
+	}
+	if len(kvsep) == 0 {
+		L.ArgError(1, "kvsep can not be empty")
+	}
+	L.Push(L.NewClosure(_luaParseKv, sep, kvsep))
+	return 1
+}
+
+func _luaParseCsv(L *lua.LState) int {
+	htbl := L.Get(lua.UpvalueIndex(1))
+	sep := L.Get(lua.UpvalueIndex(2)).String()
+	reader := csv.NewReader(strings.NewReader(L.CheckString(1)))
+	reader.Comma = []rune(sep)[0]
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		L.RaiseError("invalid csv: %s", err.Error())
+		return 0
+	}
+
+	header := []string{}
+	if tbl, ok := htbl.(*lua.LTable); ok {
+		tbl.ForEach(func(key, value lua.LValue) {
+			header = append(header, value.String())
+		})
+	} else if len(records) > 0 {
+		header = records[0]
+		records = records[1:]
+	}
+
+	ret := L.NewTable()
+	if len(records) == 0 {
+		L.Push(ret)
+		return 1
+	}
+	for i, value := range records[0] {
+		if i >= len(header) {
+			break
+		}
+		ret.RawSetString(header[i], luaStringOrNumber(value))
+	}
+	L.Push(ret)
+	return 1
+}
+
+func luaParseCsv(L *lua.LState) int {
+	tbl := L.OptTable(1, L.NewTable())
+	header := tbl.RawGetString("header")
+	if header == lua.LNil {
+		header = tbl.RawGetInt(1)
+	}
+	if header != lua.LNil && header.Type() != lua.LTTable {
+		L.ArgError(1, "header must be a table")
+	}
+	sep := lua.LString(",")
+	if lv := tbl.RawGetString("sep"); lv != lua.LNil {
+		sep = lua.LString(lv.String())
+	}
+	if len(sep) == 0 {
+		L.ArgError(1, "sep can not be empty")
+	}
+	L.Push(L.NewClosure(_luaParseCsv, header, sep))
+	return 1
+}
+
+func _luaParseRegexp(L *lua.LState) int {
+	re := L.Get(lua.UpvalueIndex(1)).(*lua.LUserData).Value.(*regexp.Regexp)
+	ret := L.NewTable()
+	match := re.FindStringSubmatch(L.CheckString(1))
+	for i, name := range re.SubexpNames() {
+		if i == 0 || len(name) == 0 || match == nil {
+			continue
+		}
+		ret.RawSetString(name, luaStringOrNumber(match[i]))
+	}
+	L.Push(ret)
+	return 1
+}
+
+func luaParseRegexp(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	pattern := tbl.RawGetString("pattern")
+	if pattern == lua.LNil {
+		pattern = tbl.RawGetInt(1)
+	}
+	re, err := regexp.Compile(lua.LVAsString(pattern))
+	if err != nil {
+		L.ArgError(1, err.Error())
+		return 0
+	}
+	ud := L.NewUserData()
+	ud.Value = re
+	L.Push(L.NewClosure(_luaParseRegexp, ud))
+	return 1
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule determines when targets run.
+type schedule interface {
+	// next returns the next time after the t.
+	next(t time.Time) time.Time
+}
+
+// intervalSchedule runs targets at a fixed rate. Run times are aligned to the
+// start time, so that periods do not drift by run times. Runs that are
+// missed because of long runs are skipped.
+type intervalSchedule struct {
+	start    time.Time
+	interval time.Duration
+}
+
+func (s *intervalSchedule) next(t time.Time) time.Time {
+	if t.Before(s.start) {
+		return s.start
+	}
+	n := t.Sub(s.start)/s.interval + 1
+	return s.start.Add(n * s.interval)
+}
+
+// cronSchedule is a schedule of the cron format:
+// "minute hour day-of-month month day-of-week".
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are true if the field starts with "*". If both of
+	// the day fields are restricted, the day matches either of them.
+	domStar, dowStar bool
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDowNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// parseCronField parses a field like "*", "*/5", "1-10/2" and "1,3,5" into a
+// bitset.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step '%s'", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], names); err != nil {
+					return 0, fmt.Errorf("invalid value '%s'", part)
+				}
+			} else if step > 1 {
+				// "5/10" means "5-max/10"
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseSchedule parses a cron expression or "@every DURATION". interval
+// schedules start at the start.
+func parseSchedule(spec string, start time.Time) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("interval of '%s' must be at least 1s", spec)
+		}
+		return &intervalSchedule{start: start.Add(d), interval: d}, nil
+	}
+	if strings.HasPrefix(spec, "@") {
+		expr, ok := cronDescriptors[spec]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule '%s'", spec)
+		}
+		spec = expr
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule '%s' must have 5 fields", spec)
+	}
+	// fields that start with "*"(i.e. "*/2") are unrestricted like cron
+	s := &cronSchedule{domStar: strings.HasPrefix(fields[2], "*"), dowStar: strings.HasPrefix(fields[4], "*")}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %s", err.Error())
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %s", err.Error())
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %s", err.Error())
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("month: %s", err.Error())
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDowNames); err != nil {
+		return nil, fmt.Errorf("day of week: %s", err.Error())
+	}
+	// 7 is also Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if s.next(start).IsZero() {
+		return nil, fmt.Errorf("schedule '%s' never matches", spec)
+	}
+	return s, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a schedule that never matches(i.e. "0 0 30 2 *") returns the zero time
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// newSchedule returns the schedule of the target. Targets without the
+// schedule run every interval.
+func (t *target) newSchedule(start time.Time) (schedule, error) {
+	if len(t.Schedule) != 0 {
+		return parseSchedule(t.Schedule, start)
+	}
+	if t.Interval <= 0 {
+		return nil, fmt.Errorf("interval must be a positive number")
+	}
+	interval := time.Duration(t.Interval) * time.Second
+	return &intervalSchedule{start: start.Add(interval), interval: interval}, nil
+}
+
+// splayOf returns a delay of runs of the target. The delay is derived from
+// the host name and the target, so that targets of many hosts do not run at
+// the same time while each target runs at a fixed period.
+func (t *target) splayOf() time.Duration {
+	if t.Splay <= 0 {
+		return 0
+	}
+	hostname, _ := os.Hostname()
+	h := fnv.New64a()
+	h.Write([]byte(hostname + "\x00" + t.Path))
+	return time.Duration(h.Sum64() % uint64(int64(t.Splay)*int64(time.Second)))
+}
+
+// nextRun returns the next run time of the target after the now. The splay
+// is added to each time of the schedule.
+func (t *target) nextRun(now time.Time) time.Time {
+	return t.schedule.next(now.Add(-t.splay)).Add(t.splay)
+}
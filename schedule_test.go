@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	cases := []struct {
+		spec  string
+		start time.Time
+		want  time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC), time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 0 13 * *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+		// both of the day fields are restricted: either of them
+		{"0 0 13 * fri", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		// a field that starts with "*" is unrestricted: both of them
+		{"0 0 */2 * mon", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// month and year rollovers
+		{"30 12 31 * *", time.Date(2024, 1, 31, 13, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 12, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := parseSchedule(c.spec, c.start)
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err.Error())
+			continue
+		}
+		if got := s.next(c.start); !got.Equal(c.want) {
+			t.Errorf("%s: next(%s) = %s, want %s", c.spec, c.start, got, c.want)
+		}
+	}
+}
+
+func TestCronScheduleNeverMatches(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := parseSchedule("0 0 30 2 *", start); err == nil {
+		t.Errorf("0 0 30 2 *: must not be accepted")
+	}
+	s := &cronSchedule{minute: 1, hour: 1, dom: 1 << 30, month: 1 << 2, dow: 0x7f, dowStar: true}
+	if got := s.next(start); !got.IsZero() {
+		t.Errorf("0 0 30 2 *: next(%s) = %s, want the zero time", start, got)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// fileIdentity is not supported on Windows, logias detects rotations by
+// headers and sizes of files.
+func fileIdentity(fi os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
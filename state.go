@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const stateDirName = "state"
+
+// stateFormatVersion is a version of the saved state format. Saved states
+// of other versions are discarded.
+const stateFormatVersion = 1
+
+// savedState is a target.State written into the stat_dir. Lua values are
+// converted by luaToSpoolValue.
+type savedState struct {
+	Format  int
+	Version string
+	Target  string
+	SavedAt time.Time
+	State   interface{}
+}
+
+func (cfg *config) stateSaveInterval() time.Duration {
+	if cfg.StateSaveInterval <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(cfg.StateSaveInterval) * time.Second
+}
+
+func (wk *worker) statePath() string {
+	return filepath.Join(wk.config.StatDir, stateDirName, strings.TrimSuffix(dataPathOf(wk.target.Path), ".txt")+".json")
+}
+
+// saveState writes the state of the target into the stat_dir if the target
+// has the persist_state flag.
+func (wk *worker) saveState() {
+	if !wk.target.PersistState {
+		return
+	}
+	path := wk.statePath()
+	data, err := json.Marshal(&savedState{
+		Format:  stateFormatVersion,
+		Version: wk.target.StateVersion,
+		Target:  wk.target.Path,
+		SavedAt: time.Now(),
+		State:   luaToSpoolValue(wk.target.State),
+	})
+	if err != nil {
+		wk.systemError(logLevelError.String(), "can not encode the state of %s: %s", wk.target.Path, err.Error())
+		return
+	}
+	if err := writeFile(string(data), path+".tmp"); err != nil {
+		wk.systemError(logLevelError.String(), "failed to write the state file %s: %s", path, err.Error())
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		wk.systemError(logLevelError.String(), "failed to write the state file %s: %s", path, err.Error())
+	}
+}
+
+// restoreState restores the saved state of the target. Saved values are
+// merged into the state created by the initial_state, so that values that
+// can not be saved(i.e. functions) are kept. States saved with another
+// state_version are discarded.
+func (wk *worker) restoreState() {
+	if !wk.target.PersistState {
+		return
+	}
+	path := wk.statePath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			wk.systemError(logLevelError.String(), "failed to read the state file %s: %s", path, err.Error())
+		}
+		return
+	}
+	ss := &savedState{}
+	if err := json.Unmarshal(data, ss); err != nil {
+		wk.logger().warn("broken state file %s is discarded: %s", path, err.Error())
+		os.Remove(path)
+		return
+	}
+	if ss.Format != stateFormatVersion || ss.Version != wk.target.StateVersion {
+		wk.logger().info("saved state of %s is discarded because the state_version was changed.", wk.target.Path)
+		os.Remove(path)
+		return
+	}
+	saved, ok := spoolValueToLua(wk.L, ss.State).(*lua.LTable)
+	if !ok {
+		return
+	}
+	mergeLuaTable(wk.target.State, saved)
+	wk.logger().info("state of %s restored(saved at %s).", wk.target.Path, ss.SavedAt.Format(time.RFC3339))
+}
+
+func (wk *worker) removeSavedState() {
+	path := wk.statePath()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		wk.systemError(logLevelError.String(), "failed to remove the state file %s: %s", path, err.Error())
+	}
+}
+
+// mergeLuaTable overwrites values of the dst by values of the src. Nested
+// tables are merged recursively.
+func mergeLuaTable(dst, src *lua.LTable) {
+	src.ForEach(func(key, value lua.LValue) {
+		if stbl, ok := value.(*lua.LTable); ok {
+			if dtbl, ok := dst.RawGet(key).(*lua.LTable); ok {
+				mergeLuaTable(dtbl, stbl)
+				return
+			}
+		}
+		dst.RawSet(key, value)
+	})
+}
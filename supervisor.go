@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// workerCrash is sent to the dispatcher when a worker panics or can not be
+// started.
+type workerCrash struct {
+	path string
+	// worker is nil if the worker could not be created.
+	worker  *worker
+	message string
+	stack   string
+}
+
+// crashState is a state of consecutive crashes of the target.
+type crashState struct {
+	count int
+	// pending is true while the restart of the worker is scheduled.
+	pending bool
+	failed  bool
+}
+
+func (cfg *config) maxCrashes() int {
+	if cfg.MaxCrashes <= 0 {
+		return 5
+	}
+	return cfg.MaxCrashes
+}
+
+func crashBackoff(count int) time.Duration {
+	d := time.Second
+	for i := 1; i < count && d < 5*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+// recoverCrash recovers a panic of the worker and reports it to the
+// dispatcher. This must be deferred in the goroutine of the worker.
+func (wk *worker) recoverCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	// the worker no longer accepts stop and control requests
+	wk.closeDone()
+	wk.L.Close()
+	wk.shared.crashc <- &workerCrash{
+		path:    wk.target.Path,
+		worker:  wk,
+		message: fmt.Sprint(r),
+		stack:   string(debug.Stack()),
+	}
+}
+
+// closeDone closes the donec. This may be called more than once, i.e. when
+// the worker panics while stopping.
+func (wk *worker) closeDone() {
+	wk.doneOnce.Do(func() { close(wk.donec) })
+}
+
+// quit sends the wg to the worker. The wg is done immediately if the worker
+// has already crashed.
+func (wk *worker) quit(wg *sync.WaitGroup) {
+	select {
+	case wk.quitc <- wg:
+	case <-wk.donec:
+		wg.Done()
+	}
+}
+
+// isCrashed returns true if the worker of the target is waiting for the
+// restart or has failed.
+func (dp *dispatcher) isCrashed(path string) bool {
+	cs, ok := dp.crashes[path]
+	return ok && (cs.pending || cs.failed)
+}
+
+// handleCrash reports the crash and schedules the restart of the worker. A
+// target is marked as failed after max_crashes consecutive crashes.
+func (dp *dispatcher) handleCrash(c *workerCrash) {
+	if c.worker != nil && dp.workers[c.path] != c.worker {
+		// the worker has been replaced by a reload
+		return
+	}
+	cs, ok := dp.crashes[c.path]
+	if !ok {
+		cs = &crashState{}
+		dp.crashes[c.path] = cs
+	}
+	if c.worker != nil && c.worker.runs > 0 {
+		// the worker had been working since the last restart
+		cs.count = 0
+	}
+	cs.count++
+	msg := fmt.Sprintf("worker %s crashed: %s", c.path, c.message)
+	if len(c.stack) != 0 {
+		msg += "\n" + c.stack
+	}
+	dp.systemError(logLevelCrit.String(), "%s", msg)
+
+	if cs.count >= dp.config.maxCrashes() {
+		cs.failed = true
+		if c.worker != nil {
+			c.worker.status.setFailed(true)
+		}
+		dp.shared.metrics.set("logias_target_failed", 1, "target", c.path)
+		dp.systemError(logLevelCrit.String(), "target %s failed after %d consecutive crashes, it will not be restarted until the configuration is reloaded.", c.path, cs.count)
+		return
+	}
+	cs.pending = true
+	backoff := crashBackoff(cs.count)
+	dp.shared.logger.warn("restarting the worker %s in %s.", c.path, backoff)
+	path := c.path
+	time.AfterFunc(backoff, func() { dp.restartc <- path })
+}
+
+// restartWorker restarts the crashed worker. Restarted workers start with a
+// state created by the initial_state(or the persisted state).
+func (dp *dispatcher) restartWorker(path string) {
+	cs, ok := dp.crashes[path]
+	if !ok || !cs.pending {
+		// cancelled by a reload
+		return
+	}
+	cs.pending = false
+	wk, err := newWorker(dp.path, path, dp.shared)
+	if err != nil {
+		dp.handleCrash(&workerCrash{path: path, message: err.Error()})
+		return
+	}
+	wk.restoreState()
+	dp.workers[path] = wk
+	go wk.run()
+	dp.shared.logger.info("worker %s restarted.", path)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// defaultSyslogSdId is a default SD-ID of structured data in syslog
+// messages. 32473 is the example enterprise number of RFC 5612, so users
+// should set their own enterprise number by the sd_id.
+const defaultSyslogSdId = "logias@32473"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+type syslogConfig struct {
+	// Network is one of "udp", "tcp", "unix" and "unixgram". Empty network
+	// means the local syslog daemon.
+	Network  string
+	Address  string
+	Facility string
+	Tag      string
+	// SdId is an SD-ID of structured data(i.e. "logias@<enterprise number>").
+	SdId string
+}
+
+func (sc *syslogConfig) facility() (int, error) {
+	if len(sc.Facility) == 0 {
+		return syslogFacilities["daemon"], nil
+	}
+	f, ok := syslogFacilities[strings.ToLower(sc.Facility)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility '%s'", sc.Facility)
+	}
+	return f, nil
+}
+
+func (sc *syslogConfig) tag() string {
+	if len(sc.Tag) == 0 {
+		return appName
+	}
+	return sc.Tag
+}
+
+func (sc *syslogConfig) sdId() string {
+	if len(sc.SdId) == 0 {
+		return defaultSyslogSdId
+	}
+	return sc.SdId
+}
+
+func (cfg *config) syslog() *syslogConfig {
+	if cfg.Syslog == nil {
+		return &syslogConfig{}
+	}
+	return cfg.Syslog
+}
+
+func (cfg *config) logOutput() string {
+	if len(cfg.LogOutput) == 0 {
+		return "file"
+	}
+	return cfg.LogOutput
+}
+
+func (cfg *config) logFormat() string {
+	if len(cfg.LogFormat) == 0 {
+		return "text"
+	}
+	return cfg.LogFormat
+}
+
+func syslogSeverity(level logLevel) int {
+	switch level {
+	case logLevelDebug:
+		return 7
+	case logLevelInfo:
+		return 6
+	case logLevelWarn:
+		return 4
+	case logLevelError:
+		return 3
+	case logLevelCrit:
+		return 2
+	}
+	return 5
+}
+
+func syslogSdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// formatRFC5424 formats the message as a RFC 5424 syslog message.
+func formatRFC5424(facility int, level logLevel, tag, msgid, sdId string, fields map[string]string, msg string) string {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	if len(msgid) == 0 {
+		msgid = "-"
+	}
+	sd := "-"
+	if len(fields) != 0 {
+		keys := []string{}
+		for k, _ := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		params := []string{sdId}
+		for _, k := range keys {
+			name := strings.Map(func(r rune) rune {
+				if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+					return '_'
+				}
+				return r
+			}, k)
+			params = append(params, fmt.Sprintf(`%s="%s"`, name, syslogSdEscape(fields[k])))
+		}
+		sd = "[" + strings.Join(params, " ") + "]"
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		facility*8+syslogSeverity(level), time.Now().Format(time.RFC3339Nano), hostname, tag, os.Getpid(), msgid, sd, msg)
+}
+
+// syslogWriter sends messages to a syslog server. Connections are
+// re-established when writes fail. Redials are backed off while the server is
+// unreachable.
+type syslogWriter struct {
+	sync.Mutex
+	network string
+	address string
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func newSyslogWriter(network, address string) *syslogWriter {
+	return &syslogWriter{network: network, address: address}
+}
+
+func (w *syslogWriter) dial() error {
+	if time.Now().Before(w.retryAt) {
+		return fmt.Errorf("not connected, retrying at %s", w.retryAt.Format(time.RFC3339))
+	}
+	if err := w._dial(); err != nil {
+		w.backoff *= 2
+		if w.backoff < time.Second {
+			w.backoff = time.Second
+		}
+		if w.backoff > time.Minute {
+			w.backoff = time.Minute
+		}
+		w.retryAt = time.Now().Add(w.backoff)
+		return err
+	}
+	w.backoff = 0
+	return nil
+}
+
+func (w *syslogWriter) _dial() error {
+	if len(w.network) != 0 {
+		conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+	// local syslog daemon
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				w.conn = conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("can not connect to the local syslog daemon")
+}
+
+func (w *syslogWriter) write(msg string) error {
+	w.Lock()
+	defer w.Unlock()
+	data := msg
+	if w.network == "tcp" || w.network == "tcp4" || w.network == "tcp6" {
+		// octet counting framing(RFC 6587)
+		data = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if err = w.dial(); err != nil {
+				return err
+			}
+		}
+		if _, err = w.conn.Write([]byte(data)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *syslogWriter) close() {
+	w.Lock()
+	defer w.Unlock()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// journalMessage formats fields in the journald native protocol.
+func journalMessage(fields map[string]string) []byte {
+	var buf bytes.Buffer
+	keys := []string{}
+	for k, _ := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fields[k]
+		if strings.Contains(v, "\n") {
+			buf.WriteString(k)
+			buf.WriteString("\n")
+			binary.Write(&buf, binary.LittleEndian, uint64(len(v)))
+			buf.WriteString(v)
+			buf.WriteString("\n")
+		} else {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// journalFieldName converts the name into a valid journal field name.
+func journalFieldName(name string) string {
+	name = strings.ToUpper(name)
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.TrimLeft(name, "_"))
+}
+
+func journalFields(level logLevel, tag string, fields map[string]string, msg string) map[string]string {
+	ret := map[string]string{}
+	for k, v := range fields {
+		ret[journalFieldName(k)] = v
+	}
+	ret["MESSAGE"] = msg
+	ret["PRIORITY"] = fmt.Sprint(syslogSeverity(level))
+	ret["SYSLOG_IDENTIFIER"] = tag
+	return ret
+}
+
+// logSink is a destination of the logger other than files.
+type logSink interface {
+	write(level logLevel, ctx *logContext, kind, msg string) error
+	close()
+}
+
+func logContextFields(ctx *logContext, kind string) map[string]string {
+	fields := map[string]string{"kind": kind}
+	if len(ctx.target) != 0 {
+		fields["target"] = ctx.target
+	}
+	if len(ctx.targetType) != 0 {
+		fields["target_type"] = ctx.targetType
+	}
+	return fields
+}
+
+// asyncSink writes logs to the sink in its own goroutine, so that a slow or
+// unreachable syslog server does not block workers. Logs are dropped while
+// the buffer is full.
+type asyncSink struct {
+	name    string
+	sink    logSink
+	queuec  chan *sinkRecord
+	donec   chan struct{}
+	dropped int64
+}
+
+type sinkRecord struct {
+	level logLevel
+	ctx   logContext
+	kind  string
+	msg   string
+}
+
+func newAsyncSink(name string, sink logSink) *asyncSink {
+	s := &asyncSink{
+		name:   name,
+		sink:   sink,
+		queuec: make(chan *sinkRecord, 1000),
+		donec:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *asyncSink) run() {
+	defer close(s.donec)
+	defer s.sink.close()
+	failing := false
+	for r := range s.queuec {
+		err := s.sink.write(r.level, &r.ctx, r.kind, r.msg)
+		if err != nil {
+			// errors are reported once until the sink recovers
+			if !failing {
+				fmt.Fprintf(os.Stderr, "can not write logs to %s: %s\n", s.name, err.Error())
+			}
+			failing = true
+			continue
+		}
+		if failing {
+			fmt.Fprintf(os.Stderr, "writing logs to %s recovered.\n", s.name)
+			failing = false
+		}
+		if n := atomic.SwapInt64(&s.dropped, 0); n > 0 {
+			fmt.Fprintf(os.Stderr, "%d logs to %s were dropped because the buffer was full.\n", n, s.name)
+		}
+	}
+}
+
+func (s *asyncSink) write(level logLevel, ctx *logContext, kind, msg string) error {
+	select {
+	case s.queuec <- &sinkRecord{level, *ctx, kind, msg}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return nil
+}
+
+// close flushes buffered logs. Logs that can not be written in 5 seconds are
+// discarded.
+func (s *asyncSink) close() {
+	close(s.queuec)
+	select {
+	case <-s.donec:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+type syslogSink struct {
+	writer   *syslogWriter
+	facility int
+	tag      string
+	sdId     string
+}
+
+func newSyslogSink(sc *syslogConfig) (*syslogSink, error) {
+	facility, err := sc.facility()
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{newSyslogWriter(sc.Network, sc.Address), facility, sc.tag(), sc.sdId()}, nil
+}
+
+func (s *syslogSink) write(level logLevel, ctx *logContext, kind, msg string) error {
+	return s.writer.write(formatRFC5424(s.facility, level, s.tag, "", s.sdId, logContextFields(ctx, kind), msg))
+}
+
+func (s *syslogSink) close() {
+	s.writer.close()
+}
+
+type journalSink struct {
+	writer *syslogWriter
+	tag    string
+}
+
+func newJournalSink(sc *syslogConfig) *journalSink {
+	return &journalSink{newSyslogWriter("unixgram", journalSocket), sc.tag()}
+}
+
+func (s *journalSink) write(level logLevel, ctx *logContext, kind, msg string) error {
+	fields := map[string]string{}
+	for k, v := range logContextFields(ctx, kind) {
+		fields["logias_"+k] = v
+	}
+	return s.writer.write(string(journalMessage(journalFields(level, s.tag, fields, msg))))
+}
+
+func (s *journalSink) close() {
+	s.writer.close()
+}
+
+func luaSyslog(L *lua.LState) int {
+	th := goThread(L)
+	tbl := L.CheckTable(1)
+	sc := *th.config.syslog()
+	if lv := tbl.RawGetString("network"); lv != lua.LNil {
+		sc.Network = lua.LVAsString(lv)
+	}
+	if lv := tbl.RawGetString("address"); lv != lua.LNil {
+		sc.Address = lua.LVAsString(lv)
+	}
+	if lv := tbl.RawGetString("facility"); lv != lua.LNil {
+		sc.Facility = lua.LVAsString(lv)
+	}
+	if lv := tbl.RawGetString("tag"); lv != lua.LNil {
+		sc.Tag = lua.LVAsString(lv)
+	}
+	if lv := tbl.RawGetString("sd_id"); lv != lua.LNil {
+		sc.SdId = lua.LVAsString(lv)
+	}
+	level := logLevelInfo
+	if lv := tbl.RawGetString("level"); lv != lua.LNil {
+		if level = logLevelOf(lua.LVAsString(lv)); level == logLevelUnknown {
+			level = logLevelInfo
+		}
+	}
+	fields := map[string]string{}
+	if lfields, ok := tbl.RawGetString("fields").(*lua.LTable); ok {
+		lfields.ForEach(func(key, value lua.LValue) {
+			fields[key.String()] = lua.LVAsString(value)
+		})
+	}
+	msg := lua.LVAsString(tbl.RawGetString("message"))
+
+	var err error
+	if lua.LVAsBool(tbl.RawGetString("journald")) {
+		w := newSyslogWriter("unixgram", journalSocket)
+		err = w.write(string(journalMessage(journalFields(level, sc.tag(), fields, msg))))
+		w.close()
+	} else {
+		var facility int
+		if facility, err = sc.facility(); err == nil {
+			w := newSyslogWriter(sc.Network, sc.Address)
+			err = w.write(formatRFC5424(facility, level, sc.tag(), lua.LVAsString(tbl.RawGetString("msgid")), sc.sdId(), fields, msg))
+			w.close()
+		}
+	}
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
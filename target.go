@@ -4,47 +4,191 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type target struct {
 	Type         string
 	Path         string
+	Paths        []string
 	Interval     int
+	Schedule     string
+	Splay        int
+	RunAtStart   bool
+	Timeout      int
+	WithStatus   bool
 	InitialState *lua.LFunction
 	State        *lua.LTable
 	Parser       *lua.LFunction
 	Fn           *lua.LFunction
 	FilterGroups [][]*filter
+	Multiline    *multiline
+	Watch        bool
+	GzipRotated  bool
+	Encoding     string
+	Debug        bool
+	// ExportMetrics is true or a list of field names.
+	ExportMetrics interface{}
+	PersistState  bool
+	StateVersion  string
 
-	_dataPath string
+	fingerprint string
+	decoder     *encoding.Decoder
+	schedule    schedule
+	splay       time.Duration
 }
 
-func (t *target) init(L *lua.LState) {
+func (t *target) init(L *lua.LState) error {
+	sched, err := t.newSchedule(time.Now())
+	if err != nil {
+		return err
+	}
+	t.schedule = sched
+	t.splay = t.splayOf()
+	if len(t.Encoding) != 0 {
+		enc, err := lookupEncoding(t.Encoding)
+		if err != nil {
+			return err
+		}
+		t.decoder = enc.NewDecoder()
+	}
+	if t.Multiline != nil {
+		if err := t.Multiline.init(); err != nil {
+			return err
+		}
+	}
 	for _, group := range t.FilterGroups {
 		for _, filter := range group {
-			filter.init()
+			if err := filter.init(); err != nil {
+				return err
+			}
 		}
 	}
-	t.initState(L)
+	return t.initState(L)
 }
 
-func (t *target) initState(L *lua.LState) {
+func (t *target) initState(L *lua.LState) error {
 	if err := L.CallByParam(lua.P{Fn: t.InitialState, NRet: 1, Protect: true}); err != nil {
-		panic(err)
+		return err
 	}
-	t.State = L.Get(-1).(*lua.LTable)
+	st, ok := L.Get(-1).(*lua.LTable)
 	L.Pop(1)
+	if !ok {
+		return fmt.Errorf("initial_state of %s must return a table", t.Path)
+	}
+	t.State = st
+	return nil
+}
+
+// isMultiFile returns true if the target.FILE monitors multiple files.
+func (t *target) isMultiFile() bool {
+	return len(t.Paths) != 0 || strings.ContainsAny(t.Path, "*?[") || isDir(t.Path)
+}
+
+// patterns returns file globs of the target. Directories are expanded to
+// globs that match files in them.
+func (t *target) patterns() []string {
+	paths := t.Paths
+	if len(paths) == 0 {
+		paths = []string{t.Path}
+	}
+	ret := []string{}
+	for _, path := range paths {
+		if isDir(path) {
+			path = filepath.Join(path, "*")
+		}
+		ret = append(ret, path)
+	}
+	return ret
+}
+
+// rotatedFilePattern matches names of rotated or compressed files(i.e.
+// app.log.1, app.log-20010203, app.log.1.gz).
+var rotatedFilePattern = regexp.MustCompile(`(\.\d+|[-_.]\d{8}(\d{2})?|\.(gz|bz2|xz|zst|zip))$`)
+
+// isRotatedFile returns true if the file looks like a rotated or compressed
+// file.
+func isRotatedFile(path string) bool {
+	return rotatedFilePattern.MatchString(filepath.Base(path))
+}
+
+// expandPaths returns files that match the target. Rotated and compressed
+// files are excluded because they are read by the rotation detection.
+func (t *target) expandPaths() ([]string, error) {
+	files := []string{}
+	seen := map[string]bool{}
+	for _, pattern := range t.patterns() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range matches {
+			if !seen[file] && isFile(file) && !isRotatedFile(file) {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// decode converts the line into UTF-8 if the encoding is specified. Byte
+// sequences that can not be decoded are replaced with U+FFFD and the rest of
+// the line is still converted.
+func (t *target) decode(line string) string {
+	if t.decoder == nil {
+		return line
+	}
+	var buf strings.Builder
+	src := []byte(line)
+	dst := make([]byte, 3*len(src)+utf8.UTFMax)
+	t.decoder.Reset()
+	for len(src) > 0 {
+		nDst, nSrc, err := t.decoder.Transform(dst, src, true)
+		buf.Write(dst[:nDst])
+		src = src[nSrc:]
+		if err == nil {
+			break
+		}
+		if err == transform.ErrShortDst && nSrc != 0 {
+			continue
+		}
+		// skips a byte that can not be decoded
+		buf.WriteString("\uFFFD")
+		if len(src) != 0 {
+			src = src[1:]
+		}
+		t.decoder.Reset()
+	}
+	return buf.String()
+}
+
+// dataPathOf returns a name of the stat file for the path.
+func dataPathOf(path string) string {
+	return fmt.Sprintf("%x_%s.txt", sha1.Sum([]byte(path)), filepath.Base(path))
 }
 
-func (t *target) dataPath() string {
-	if len(t._dataPath) == 0 {
-		t._dataPath = fmt.Sprintf("%x_%s.txt", sha1.Sum([]byte(t.Path)), filepath.Base(t.Path))
+// fileDataPathOf returns a name of the stat file for the file of the target.
+// Files of multi-file targets are keyed by the target too, so that a file
+// matched by several targets has a position for each target.
+func (t *target) fileDataPathOf(path string) string {
+	if path == t.Path {
+		return dataPathOf(path)
 	}
-	return t._dataPath
+	return fmt.Sprintf("%x_%s.txt", sha1.Sum([]byte(t.Path+"\x00"+path)), filepath.Base(path))
 }
 
 type fileData struct {
 	header   string
 	position int64
+	inode    uint64
+	device   uint64
+	// checksum is a checksum of bytes just before the position.
+	checksum string
 }
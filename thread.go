@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"github.com/yuin/gopher-lua"
 	"os"
-	"sync"
+	"time"
 )
 
 type shared struct {
-	logger *logger
-	quitc  chan *sync.WaitGroup
+	logger    *logger
+	alerts    *alertManager
+	limiter   *notifierLimiter
+	deliverer *deliverer
+	metrics   *metricsRegistry
+	// crashc receives crashes of workers.
+	crashc chan *workerCrash
 }
 
 type thread struct {
@@ -18,19 +23,39 @@ type thread struct {
 	shared       *shared
 	luaUd        *lua.LUserData
 	isInDowntime bool
+	// currentPath is a path of the file being processed.
+	currentPath string
+	// matchedLines is a list of recent lines that reached notify filters.
+	matchedLines []string
+	// logCtx is attached to logs of this thread.
+	logCtx logContext
+	// logKind is a kind of logs written by the log function.
+	logKind string
+	// the last error reported by systemError.
+	lastError   string
+	lastErrorAt time.Time
 }
 
-func mustNewThread(path string, s *shared) *thread {
-	th := &thread{lua.NewState(), nil, s, nil, false}
+func newThread(path string, s *shared) (*thread, error) {
+	th := &thread{lua.NewState(), nil, s, nil, false, "", []string{}, logContext{}, logKindLua, "", time.Time{}}
 	th.luaUd = th.L.NewUserData()
 	th.beforeLoadConfig()
 	cfg, err := loadConfig(th.L, path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "can not load %s:\n\n%s", path, err.Error())
-		os.Exit(1)
+		th.L.Close()
+		return nil, err
 	}
 	th.config = cfg
 	th.afterLoadConfig()
+	return th, nil
+}
+
+func mustNewThread(path string, s *shared) *thread {
+	th, err := newThread(path, s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can not load %s:\n\n%s", path, err.Error())
+		os.Exit(1)
+	}
 	return th
 }
 
@@ -70,6 +95,13 @@ func (th *thread) checkDowntime() {
 }
 
 func (th *thread) systemError(level, format string, args ...interface{}) {
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	th.lastError = msg
+	th.lastErrorAt = time.Now()
+
 	fn := th.config.Downtime
 	if !lua.LVIsFalse(fn) {
 		if err := th.callLua(fn, 1); err == nil {
@@ -80,10 +112,11 @@ func (th *thread) systemError(level, format string, args ...interface{}) {
 		// ignore errors while calling the downtime function
 	}
 
-	msg := format
-	if len(args) > 0 {
-		msg = fmt.Sprintf(format, args...)
-	}
-
+	th.logKind = logKindSystemError
+	defer func() { th.logKind = logKindLua }()
 	th.callLua(th.config.OnSystemError, 1, lua.LString(level), lua.LString(msg))
 }
+
+func (th *thread) logger() *contextLogger {
+	return &contextLogger{th.shared.logger, &th.logCtx}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
 	"io"
 	"io/ioutil"
 	"os"
@@ -12,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type H map[string]interface{}
@@ -85,7 +91,11 @@ func writeFile(data string, path string) error {
 	return nil
 }
 
-const popenError = 500
+const (
+	popenError    = 500
+	popenTimeout  = 501
+	popenCanceled = 502
+)
 
 func popenArgs(arg string) (string, []string) {
 	cmd := "/bin/sh"
@@ -110,20 +120,77 @@ func exitStatus(err error) int {
 	return 0
 }
 
-func shellStdout(cmd string) (int, string) {
+type cmdResult struct {
+	status   int
+	stdout   string
+	stderr   string
+	duration time.Duration
+	// message describes why the command failed.
+	message string
+}
+
+// failureMessage returns the message with the captured output of the
+// command.
+func (r *cmdResult) failureMessage() string {
+	msg := r.message
+	if out := strings.Trim(r.stderr, " \t\n"); len(out) != 0 {
+		msg += "\nstderr: " + out
+	}
+	if out := strings.Trim(r.stdout, " \t\n"); len(out) != 0 {
+		msg += "\nstdout: " + out
+	}
+	return msg
+}
+
+// shellExec runs the cmd and returns its result. The whole process group is
+// killed when the timeout(0 means no timeout) is exceeded or the cancelc is
+// closed.
+func shellExec(cmd string, timeout time.Duration, cancelc <-chan struct{}) *cmdResult {
 	c, args := popenArgs(cmd)
 	pp := exec.Command(c, args...)
-	var out bytes.Buffer
-	pp.Stdout = &out
+	setProcessGroup(pp)
+	var stdout, stderr bytes.Buffer
+	pp.Stdout = &stdout
+	pp.Stderr = &stderr
+	result := &cmdResult{}
+	start := time.Now()
 	err := pp.Start()
 	if err != nil {
-		return popenError, err.Error()
+		result.status = popenError
+		result.message = err.Error()
+		return result
 	}
-	err = pp.Wait()
-	if err != nil {
-		return exitStatus(err), err.Error()
+	donec := make(chan error, 1)
+	go func() {
+		donec <- pp.Wait()
+	}()
+	var timeoutc <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutc = timer.C
+	}
+	select {
+	case err = <-donec:
+		if err != nil {
+			result.status = exitStatus(err)
+			result.message = err.Error()
+		}
+	case <-timeoutc:
+		killProcessGroup(pp)
+		<-donec
+		result.status = popenTimeout
+		result.message = fmt.Sprintf("command timed out after %d s", int(timeout/time.Second))
+	case <-cancelc:
+		killProcessGroup(pp)
+		<-donec
+		result.status = popenCanceled
+		result.message = "command canceled"
 	}
-	return 0, out.String()
+	result.duration = time.Since(start)
+	result.stdout = stdout.String()
+	result.stderr = stderr.String()
+	return result
 }
 
 func parseNumber(number string) (float64, error) {
@@ -218,3 +285,40 @@ func readFileLine(fp *os.File) (string, error) {
 	}
 	return string(result), err
 }
+
+// readHeader returns the first line of the file.
+func readHeader(path string) string {
+	fp, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+	line, _ := bufio.NewReader(fp).ReadString('\n')
+	return strings.Trim(line, "\n")
+}
+
+// readGzipHeader returns the first line of the gzipped file.
+func readGzipHeader(path string) string {
+	fp, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+	gzr, err := gzip.NewReader(fp)
+	if err != nil {
+		return ""
+	}
+	defer gzr.Close()
+	line, _ := bufio.NewReader(gzr).ReadString('\n')
+	return strings.Trim(line, "\n")
+}
+
+// lookupEncoding returns a character encoding by the name like "Shift_JIS"
+// and "EUC-JP".
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding '%s'", name)
+	}
+	return enc, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// fileWatcher watches files using the inotify. Parent directories of the
+// files are watched so that moved, deleted and re-created files are detected.
+type fileWatcher struct {
+	file *os.File
+	// names maps watch descriptors to file name globs.
+	names  map[int32][]string
+	eventc chan struct{}
+}
+
+func newFileWatcher(patterns []string) (*fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("can not initialize inotify: %s", err.Error())
+	}
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB)
+	names := map[int32][]string{}
+	for _, pattern := range patterns {
+		dir := filepath.Dir(pattern)
+		if strings.ContainsAny(dir, "*?[") {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("can not watch %s: globs in directory names are not supported", pattern)
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("can not watch %s: %s", dir, err.Error())
+		}
+		names[int32(wd)] = append(names[int32(wd)], filepath.Base(pattern))
+	}
+	w := &fileWatcher{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		names:  names,
+		eventc: make(chan struct{}, 1),
+	}
+	go w.loop()
+	return w, nil
+}
+
+func (w *fileWatcher) match(wd int32, name string) bool {
+	for _, pattern := range w.names[wd] {
+		if ok, _ := filepath.Match(pattern, name); ok || pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fileWatcher) loop() {
+	var buf [syscall.SizeofInotifyEvent * 256]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[0 : len(name)-1]
+			}
+			if w.match(ev.Wd, name) || ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.notify()
+			}
+		}
+	}
+}
+
+// notify wakes up the worker. Events are coalesced while the worker is busy.
+func (w *fileWatcher) notify() {
+	select {
+	case w.eventc <- struct{}{}:
+	default:
+	}
+}
+
+func (w *fileWatcher) close() {
+	w.file.Close()
+}
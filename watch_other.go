@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type fileWatcher struct {
+	eventc chan struct{}
+}
+
+func newFileWatcher(patterns []string) (*fileWatcher, error) {
+	return nil, fmt.Errorf("inotify is not supported on %s", runtime.GOOS)
+}
+
+func (w *fileWatcher) notify() {
+}
+
+func (w *fileWatcher) close() {
+}
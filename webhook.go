@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gluamapper"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// luaToJsonValue converts the value into a value that can be encoded by the
+// encoding/json. Tables that have only sequential keys are converted into
+// arrays.
+func luaToJsonValue(lv lua.LValue) interface{} {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		n := v.MaxN()
+		isArray := n > 0
+		if isArray {
+			v.ForEach(func(key, value lua.LValue) {
+				if _, ok := key.(lua.LNumber); !ok {
+					isArray = false
+				}
+			})
+		}
+		if isArray {
+			ret := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				ret = append(ret, luaToJsonValue(v.RawGetInt(i)))
+			}
+			return ret
+		}
+		ret := map[string]interface{}{}
+		v.ForEach(func(key, value lua.LValue) {
+			ret[key.String()] = luaToJsonValue(value)
+		})
+		return ret
+	case *lua.LUserData:
+		// nqueues are converted into arrays of numbers
+		if q, ok := v.Value.(*nqueue); ok {
+			ret := make([]interface{}, 0, len(q.d))
+			for _, n := range q.d {
+				ret = append(ret, float64(n))
+			}
+			return ret
+		}
+	}
+	return nil
+}
+
+func webhookSlackBody(tbl *lua.LTable) interface{} {
+	text := lua.LVAsString(tbl.RawGetString("message"))
+	prefix := []string{}
+	for _, name := range []string{"level", "code"} {
+		if v := lua.LVAsString(tbl.RawGetString(name)); len(v) != 0 && v != "nil" {
+			prefix = append(prefix, v)
+		}
+	}
+	if len(prefix) != 0 {
+		text = fmt.Sprintf("[%s] %s", strings.Join(prefix, " "), text)
+	}
+	body := map[string]interface{}{"text": text}
+	for _, name := range []string{"channel", "username", "icon_emoji", "icon_url"} {
+		if v := tbl.RawGetString(name); v != lua.LNil {
+			body[name] = lua.LVAsString(v)
+		}
+	}
+	return body
+}
+
+func webhookAlertmanagerBody(tbl *lua.LTable) interface{} {
+	level := lua.LVAsString(tbl.RawGetString("level"))
+	code := lua.LVAsString(tbl.RawGetString("code"))
+	labels := map[string]interface{}{"alertname": appName}
+	if len(code) != 0 && code != "nil" {
+		labels["alertname"] = code
+	}
+	if len(level) != 0 && level != "nil" {
+		labels["severity"] = strings.ToLower(level)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		labels["instance"] = hostname
+	}
+	if ltbl, ok := tbl.RawGetString("labels").(*lua.LTable); ok {
+		ltbl.ForEach(func(key, value lua.LValue) {
+			labels[key.String()] = lua.LVAsString(value)
+		})
+	}
+	annotations := map[string]interface{}{"summary": lua.LVAsString(tbl.RawGetString("message"))}
+	if ltbl, ok := tbl.RawGetString("annotations").(*lua.LTable); ok {
+		ltbl.ForEach(func(key, value lua.LValue) {
+			annotations[key.String()] = lua.LVAsString(value)
+		})
+	}
+	now := time.Now().Format(time.RFC3339)
+	alert := map[string]interface{}{
+		"labels":      labels,
+		"annotations": annotations,
+		"startsAt":    now,
+	}
+	// INFO notifications are recoveries
+	if lv := logLevelOf(level); lv == logLevelInfo || lv == logLevelDebug {
+		alert["endsAt"] = now
+	}
+	return []interface{}{alert}
+}
+
+// webhookTemplateFuncs are functions available in body templates. Values
+// should be written by the json function, so that quotes and newlines in
+// messages do not break JSON payloads.
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// webhookBody returns a request body of the webhook.
+func webhookBody(tbl *lua.LTable) ([]byte, error) {
+	var body interface{}
+	switch preset := lua.LVAsString(tbl.RawGetString("preset")); preset {
+	case "":
+		lbody := tbl.RawGetString("body")
+		switch v := lbody.(type) {
+		case lua.LString:
+			values := tbl.RawGetString("values")
+			if values == lua.LNil {
+				return []byte(string(v)), nil
+			}
+			tpl, err := template.New("").Funcs(webhookTemplateFuncs).Parse(string(v))
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := tpl.Execute(&buf, gluamapper.ToGoValue(values, gluamapper.Option{NameFunc: gluamapper.Id})); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		case *lua.LTable:
+			body = luaToJsonValue(v)
+		case *lua.LNilType:
+			return []byte{}, nil
+		default:
+			return nil, fmt.Errorf("body must be a string or a table")
+		}
+	case "slack":
+		body = webhookSlackBody(tbl)
+	case "alertmanager":
+		body = webhookAlertmanagerBody(tbl)
+	default:
+		return nil, fmt.Errorf("unknown preset '%s'", preset)
+	}
+	return json.Marshal(body)
+}
+
+// isRetryableStatus returns true if the request should be retried.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func luaWebhook(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	lurl := tbl.RawGetString("url")
+	if lurl == lua.LNil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString("url can not be nil"))
+		return 2
+	}
+	url := lua.LVAsString(lurl)
+	method := "POST"
+	if lv := tbl.RawGetString("method"); lv != lua.LNil {
+		method = strings.ToUpper(lua.LVAsString(lv))
+	}
+	timeout := 10
+	if lv, ok := tbl.RawGetString("timeout").(lua.LNumber); ok {
+		timeout = int(lv)
+	}
+	retries := 2
+	if lv, ok := tbl.RawGetString("retries").(lua.LNumber); ok {
+		retries = int(lv)
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	if lheaders, ok := tbl.RawGetString("headers").(*lua.LTable); ok {
+		lheaders.ForEach(func(key, value lua.LValue) {
+			headers[key.String()] = lua.LVAsString(value)
+		})
+	}
+
+	body, err := webhookBody(tbl)
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	status := 0
+	backoff := time.Second
+	for i := 0; ; i++ {
+		var req *http.Request
+		req, err = http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		var res *http.Response
+		res, err = client.Do(req)
+		if err == nil {
+			status = res.StatusCode
+			rbody, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+			res.Body.Close()
+			if status >= 200 && status < 300 {
+				break
+			}
+			err = fmt.Errorf("%s %s: %s %s", method, url, res.Status, strings.TrimSpace(string(rbody)))
+			if !isRetryableStatus(status) {
+				break
+			}
+		}
+		if i >= retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		L.Push(lua.LNumber(status))
+		return 3
+	}
+	L.Push(lua.LTrue)
+	L.Push(lua.LNil)
+	L.Push(lua.LNumber(status))
+	return 3
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/yuin/gopher-lua"
+	"testing"
+)
+
+func TestWebhookBodyJsonTemplate(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`attrs = {
+	  body = '{"text": {{json .message}}, "level": {{json .level}}}',
+	  values = {message = "error: \"quoted\"\n  at line 1\\2", level = "ERROR"},
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	body, err := webhookBody(L.GetGlobal("attrs").(*lua.LTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(body) {
+		t.Fatalf("invalid JSON: %s", string(body))
+	}
+	var v map[string]string
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["text"] != "error: \"quoted\"\n  at line 1\\2" || v["level"] != "ERROR" {
+		t.Errorf("unexpected body: %s", string(body))
+	}
+}
@@ -2,121 +2,341 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/binary"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const fileMaxRead = 4096
+
 type worker struct {
 	*thread
-	target *target
+	target  *target
+	quitc   chan *sync.WaitGroup
+	cancelc chan struct{}
+	watcher *fileWatcher
+	// controlc receives functions called by the control API.
+	controlc chan func()
+	// donec is closed when the worker is stopped.
+	donec    chan struct{}
+	doneOnce sync.Once
+	status   *workerStatus
+	// runs is a number of processing since the worker was started.
+	runs int
+
+	// multiline records that are waiting for following lines, keyed by file
+	// paths.
+	pendings map[string]*pendingRecord
+	// files that matched the target in the last interval.
+	files map[string]bool
+}
+
+type pendingRecord struct {
+	position int64
+	since    time.Time
 }
 
-func newWorker(path string, fpath string, s *shared) *worker {
+func newWorker(path string, fpath string, s *shared) (*worker, error) {
+	th, err := newThread(path, s)
+	if err != nil {
+		return nil, err
+	}
 	wk := &worker{
-		thread: mustNewThread(path, s),
+		thread:   th,
+		quitc:    make(chan *sync.WaitGroup),
+		cancelc:  make(chan struct{}),
+		controlc: make(chan func()),
+		donec:    make(chan struct{}),
+		status:   &workerStatus{},
+		pendings: map[string]*pendingRecord{},
+		files:    map[string]bool{},
 	}
-	wk.target = wk.config.Targets[fpath]
-	wk.target.init(wk.L)
-	return wk
+	t, ok := wk.config.Targets[fpath]
+	if !ok {
+		th.L.Close()
+		return nil, fmt.Errorf("target %s not found", fpath)
+	}
+	wk.target = t
+	wk.logCtx = logContext{target: t.Path, targetType: t.Type}
+	if err := wk.target.init(wk.L); err != nil {
+		th.L.Close()
+		return nil, fmt.Errorf("can not initialize %s: %s", fpath, err.Error())
+	}
+	return wk, nil
 }
 
 func (wk *worker) run() {
+	defer wk.recoverCrash()
+	var eventc <-chan struct{}
+	if wk.target.Type == "FILE" && wk.target.Watch {
+		watcher, err := newFileWatcher(wk.target.patterns())
+		if err != nil {
+			wk.logger().warn("%s, falling back to polling %s", err.Error(), wk.target.Path)
+		} else {
+			defer watcher.close()
+			wk.watcher = watcher
+			eventc = watcher.eventc
+		}
+	}
+	// runs are scheduled by the wall clock, so that periods do not drift by
+	// run times and events.
+	nextRun := wk.target.nextRun(time.Now())
+	if wk.target.RunAtStart {
+		nextRun = time.Now()
+	}
+	wk.status.setNextRun(nextRun)
+	timer := time.NewTimer(time.Until(nextRun))
+	defer timer.Stop()
+	saveTicker := time.NewTicker(wk.config.stateSaveInterval())
+	defer saveTicker.Stop()
 	for {
 		select {
-		case wg := <-wk.shared.quitc:
-			wk.shared.logger.info("worker stopped.")
-			wg.Done()
+		case wg := <-wk.quitc:
+			// the wg is done even if saving the state panics
+			defer wg.Done()
+			wk.closeDone()
+			wk.saveState()
+			wk.logger().info("worker %s stopped.", wk.target.Path)
 			return
-		case <-time.After(time.Duration(wk.target.Interval) * time.Second):
-			olddt := wk.isInDowntime
-			wk.checkDowntime()
-			// clear state when downtime is closed
-			if olddt && !wk.isInDowntime {
-				wk.target.initState(wk.L)
+		case fn := <-wk.controlc:
+			fn()
+		case <-saveTicker.C:
+			wk.saveState()
+		case <-eventc:
+			if !wk.status.isPaused() {
+				wk.process()
 			}
-
-			switch wk.target.Type {
-			case "FILE":
-				wk.processFile()
-			case "CMD":
-				wk.processCmd()
-			case "LUA":
-				wk.processLua()
+		case <-timer.C:
+			if !wk.status.isPaused() {
+				wk.process()
 			}
+			nextRun = wk.target.nextRun(time.Now())
+			wk.status.setNextRun(nextRun)
+			timer.Reset(time.Until(nextRun))
+		}
+	}
+}
+
+func (wk *worker) process() {
+	olddt := wk.isInDowntime
+	wk.checkDowntime()
+	// clear state when downtime is closed
+	if olddt && !wk.isInDowntime {
+		if err := wk.target.initState(wk.L); err != nil {
+			wk.systemError(logLevelError.String(), "error while calling the initial_state function %s: %s", wk.target.Path, err.Error())
+		}
+	}
+
+	wk.currentPath = wk.target.Path
+	switch wk.target.Type {
+	case "FILE":
+		if wk.processFiles() && wk.watcher != nil {
+			// read remaining lines immediately
+			wk.watcher.notify()
 		}
+	case "CMD":
+		wk.processCmd()
+	case "LUA":
+		wk.processLua()
+	}
+	if !wk.isInDowntime {
+		wk.processAlerts()
 	}
+	wk.runs++
+	wk.updateStatus()
 }
 
-func (wk *worker) processFile() {
-	fd := wk.readFileData()
-	if fileStat(wk.target.Path) == ftNotExists {
+// cancel cancels an in-flight command of the worker.
+func (wk *worker) cancel() {
+	close(wk.cancelc)
+}
+
+func (wk *worker) stop() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	wk.cancel()
+	wk.quit(&wg)
+	wg.Wait()
+}
+
+func (wk *worker) commandTimeout() time.Duration {
+	timeout := wk.target.Timeout
+	if timeout <= 0 {
+		timeout = wk.config.CommandTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// processFiles processes files that match the target. New files are read from
+// the beginning and states of vanished files are removed. It returns true if
+// unread lines remain.
+func (wk *worker) processFiles() bool {
+	if !wk.target.isMultiFile() {
+		return wk.processFile(wk.target.Path)
+	}
+	files, err := wk.target.expandPaths()
+	if err != nil {
+		wk.systemError(logLevelError.String(), "invalid path pattern %s: %s", wk.target.Path, err.Error())
+		return false
+	}
+	more := false
+	current := map[string]bool{}
+	for _, file := range files {
+		current[file] = true
+		if !wk.files[file] {
+			wk.logger().info("%s matched %s", file, wk.target.Path)
+		}
+		if wk.processFile(file) {
+			more = true
+		}
+	}
+	for file, _ := range wk.files {
+		if current[file] {
+			continue
+		}
+		// read the rest of the file if it was rotated
+		wk.processFile(file)
+		wk.removeFileData(file)
+		wk.shared.metrics.remove("logias_file_lag_bytes", "target", wk.target.Path, "file", file)
+		delete(wk.pendings, file)
+		wk.logger().info("%s vanished", file)
+	}
+	wk.files = current
+	return more
+}
+
+// processFile reads new lines of the file. It returns true if unread lines
+// remain because of the fileMaxRead limit.
+func (wk *worker) processFile(path string) bool {
+	wk.currentPath = path
+	fd := wk.readFileData(path)
+	if fileStat(path) == ftNotExists {
+		if fd.position > 0 {
+			// the file may have been moved by a rotation
+			wk.processRotatedFile(path, fd)
+		}
 		fd.header = ""
 		fd.position = 0
-		wk.writeFileData(fd)
-		return
+		fd.inode = 0
+		fd.device = 0
+		fd.checksum = ""
+		wk.writeFileData(path, fd)
+		return false
 	}
 
-	fp, err := os.Open(wk.target.Path)
+	fp, err := os.Open(path)
 	if err != nil {
-		wk.systemError(logLevelError.String(), "can not open %s: %s", wk.target.Path, err.Error())
-		return
+		wk.systemError(logLevelError.String(), "can not open %s: %s", path, err.Error())
+		return false
 	}
 	defer fp.Close()
 
+	fi, err := fp.Stat()
+	if err != nil {
+		wk.systemError(logLevelError.String(), "can not stat %s: %s", path, err.Error())
+		return false
+	}
+	ino, dev := fileIdentity(fi)
+	rotated := fd.inode != 0 && (fd.inode != ino || fd.device != dev)
+
 	reader := bufio.NewReaderSize(fp, 4096)
 	header, err := reader.ReadString('\n')
 
 	if err == io.EOF {
-		return
+		if rotated && fd.position > 0 {
+			wk.processRotatedFile(path, fd)
+			wk.writeFileData(path, &fileData{header: "", position: 0, inode: ino, device: dev})
+		}
+		return false
 	}
 
 	if err != nil {
-		wk.systemError(logLevelError.String(), "can not read %s: %s", wk.target.Path, err.Error())
-		return
+		wk.systemError(logLevelError.String(), "can not read %s: %s", path, err.Error())
+		return false
 	}
 
 	header = strings.Trim(header, "\n")
 	pos := fd.position
 
-	fi, err := fp.Stat()
-	if err != nil {
-		wk.systemError(logLevelError.String(), "can not stat %s: %s", wk.target.Path, err.Error())
-		return
-	}
-
-	if header != fd.header || pos > fi.Size() {
-		wk.shared.logger.info("%s was truncated", wk.target.Path)
+	// copytruncate rotations keep the inode and may keep the header, and the
+	// file may have grown beyond the position before this check.
+	truncated := pos > fi.Size() || (pos > 0 && len(fd.checksum) != 0 && tailChecksum(fp, pos) != fd.checksum)
+	if rotated || header != fd.header || truncated {
+		if fd.position > 0 {
+			wk.processRotatedFile(path, fd)
+		}
+		if rotated {
+			wk.logger().info("%s was rotated", path)
+		} else {
+			wk.logger().info("%s was truncated", path)
+		}
 		pos = 0
 	}
 
 	if _, err := fp.Seek(pos, 0); err != nil {
-		wk.systemError(logLevelError.String(), "can not seek %s: %s", wk.target.Path, err.Error())
-		return
+		wk.systemError(logLevelError.String(), "can not seek %s: %s", path, err.Error())
+		return false
 	}
 
-	const maxread = 4096
-	for i := 0; i < maxread; i++ {
+	ml := wk.target.Multiline
+	record := []string{}
+	recordPos := int64(0)
+	resume := int64(-1)
+	iseof := false
+	i := 0
+	for ; i < fileMaxRead; i++ {
+		linePos := int64(0)
+		if ml != nil {
+			if linePos, err = fp.Seek(0, 1); err != nil {
+				wk.systemError(logLevelError.String(), "can not seek %s: %s", path, err.Error())
+				return false
+			}
+		}
 		line, err := readFileLine(fp)
-		iseof := err == io.EOF
+		iseof = err == io.EOF
 		if err != nil && !iseof {
-			wk.systemError(logLevelError.String(), "can not read %s: %s", wk.target.Path, err.Error())
-			return
+			wk.systemError(logLevelError.String(), "can not read %s: %s", path, err.Error())
+			return false
 		}
-		line = strings.Trim(line, "\n")
+		wk.countRead(line)
+		line = wk.target.decode(strings.Trim(line, "\n"))
 		if len(line) > 0 {
-			obj, ok := wk.applyParser(line)
-			if !ok {
-				break
-			}
-			for _, group := range wk.target.FilterGroups {
-				wk.applyFilterGroup(line, group, obj)
+			if ml == nil {
+				if !wk.processLine(line) {
+					break
+				}
+			} else {
+				if len(record) != 0 && ml.isStart(line) {
+					ok := wk.processLine(strings.Join(record, "\n"))
+					record = record[0:0]
+					if !ok {
+						// this line will be read again
+						resume = linePos
+						break
+					}
+				}
+				if len(record) == 0 {
+					recordPos = linePos
+				}
+				record = append(record, line)
+				if len(record) >= ml.maxLines() {
+					ok := wk.processLine(strings.Join(record, "\n"))
+					record = record[0:0]
+					if !ok {
+						break
+					}
+				}
 			}
 		}
 		if iseof {
@@ -126,34 +346,245 @@ func (wk *worker) processFile() {
 
 	where, err := fp.Seek(0, 1)
 	if err != nil {
-		wk.systemError(logLevelError.String(), "can not seek %s: %s", wk.target.Path, err.Error())
-		return
+		wk.systemError(logLevelError.String(), "can not seek %s: %s", path, err.Error())
+		return false
 	}
-	if fd.header == header && fd.position == where {
-		return
+	if resume > -1 {
+		where = resume
+	}
+	more := i == fileMaxRead
+	if len(record) != 0 {
+		// following lines of the record may not be written yet, so the
+		// record will be read again unless the flush timeout is exceeded.
+		// A record that fills the whole read is flushed, otherwise it would
+		// be read again forever.
+		if (iseof && wk.isPendingRecordExpired(path, recordPos)) || (more && recordPos == pos) {
+			wk.processLine(strings.Join(record, "\n"))
+		} else {
+			where = recordPos
+		}
+	}
+	wk.shared.metrics.set("logias_file_lag_bytes", float64(fi.Size()-where), "target", wk.target.Path, "file", path)
+	checksum := tailChecksum(fp, where)
+	if fd.header == header && fd.position == where && fd.inode == ino && fd.device == dev && fd.checksum == checksum {
+		return more
 	}
 
 	fd.header = header
 	fd.position = where
-	wk.writeFileData(fd)
+	fd.inode = ino
+	fd.device = dev
+	fd.checksum = checksum
+	wk.writeFileData(path, fd)
+	return more
+}
+
+// findRotatedFile finds a file that the target file was rotated to. Rotated
+// files are identified by inodes or headers and checksums. The second return value is true
+// if the file is gzipped.
+func (wk *worker) findRotatedFile(path string, fd *fileData) (string, bool) {
+	files, err := filepath.Glob(path + "?*")
+	if err != nil {
+		return "", false
+	}
+	infos := []os.FileInfo{}
+	paths := map[os.FileInfo]string{}
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() {
+			infos = append(infos, fi)
+			paths[fi] = file
+		}
+	}
+	// newer files first
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	for _, fi := range infos {
+		file := paths[fi]
+		if strings.HasSuffix(file, ".gz") {
+			if wk.target.GzipRotated && readGzipHeader(file) == fd.header && gzipContains(file, fd) {
+				return file, true
+			}
+			continue
+		}
+		ino, dev := fileIdentity(fi)
+		if fd.inode != 0 && fd.inode == ino && fd.device == dev {
+			return file, false
+		}
+		if fi.Size() >= fd.position && readHeader(file) == fd.header && (len(fd.checksum) == 0 || tailChecksumOf(file, fd.position) == fd.checksum) {
+			return file, false
+		}
+	}
+	return "", false
+}
+
+// processRotatedFile reads the rest of the rotated file.
+func (wk *worker) processRotatedFile(path string, fd *fileData) {
+	file, gz := wk.findRotatedFile(path, fd)
+	if len(file) == 0 {
+		return
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		wk.systemError(logLevelError.String(), "can not open %s: %s", file, err.Error())
+		return
+	}
+	defer fp.Close()
+
+	var r io.Reader = fp
+	if gz {
+		gzr, err := gzip.NewReader(fp)
+		if err != nil {
+			wk.systemError(logLevelError.String(), "can not read %s: %s", file, err.Error())
+			return
+		}
+		defer gzr.Close()
+		r = gzr
+		_, err = io.CopyN(ioutil.Discard, r, fd.position)
+	} else {
+		_, err = fp.Seek(fd.position, 0)
+	}
+	if err != nil {
+		wk.systemError(logLevelError.String(), "can not seek %s: %s", file, err.Error())
+		return
+	}
+
+	wk.logger().info("reading the rest of %s from %s", path, file)
+	// lines are processed as they are read, so that large rotated files are
+	// not loaded into the memory.
+	record := []string{}
+	reader := bufio.NewReaderSize(r, 4096)
+	for {
+		line, err := reader.ReadString('\n')
+		wk.countRead(line)
+		if !wk.addRecordLine(&record, wk.target.decode(strings.Trim(line, "\n"))) {
+			return
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wk.systemError(logLevelError.String(), "can not read %s: %s", file, err.Error())
+			break
+		}
+	}
+	if len(record) != 0 {
+		wk.processLine(strings.Join(record, "\n"))
+	}
+}
+
+// addRecordLine adds the line to the multiline record and processes the
+// record when the line starts a new record. It returns false if the parser
+// failed.
+func (wk *worker) addRecordLine(record *[]string, line string) bool {
+	if len(line) == 0 {
+		return true
+	}
+	ml := wk.target.Multiline
+	if ml == nil {
+		return wk.processLine(line)
+	}
+	if len(*record) != 0 && (ml.isStart(line) || len(*record) >= ml.maxLines()) {
+		if !wk.processLine(strings.Join(*record, "\n")) {
+			return false
+		}
+		*record = (*record)[0:0]
+	}
+	*record = append(*record, line)
+	return true
+}
+
+func (wk *worker) processLine(line string) bool {
+	wk.trace("line: %s", line)
+	obj, ok := wk.applyParser(line)
+	if !ok {
+		return false
+	}
+	wk.applyFilterGroups(line, obj)
+	return true
+}
+
+func (wk *worker) countRead(line string) {
+	if len(line) == 0 {
+		return
+	}
+	wk.shared.metrics.add("logias_lines_read_total", 1, "target", wk.target.Path)
+	wk.shared.metrics.add("logias_bytes_read_total", float64(len(line)), "target", wk.target.Path)
+}
+
+func (wk *worker) isPendingRecordExpired(path string, pos int64) bool {
+	pending, ok := wk.pendings[path]
+	if !ok || pending.position != pos {
+		pending = &pendingRecord{position: pos, since: time.Now()}
+		wk.pendings[path] = pending
+	}
+	timeout := wk.target.Multiline.FlushTimeout
+	if timeout <= 0 {
+		timeout = wk.target.Interval
+	}
+	return time.Since(pending.since) >= time.Duration(timeout)*time.Second
 }
 
 func (wk *worker) processCmd() {
-	status, output := shellStdout(wk.target.Path)
-	if status != 0 {
-		wk.systemError(logLevelError.String(), "command failed %s: %s", wk.target.Path, output)
+	result := shellExec(wk.target.Path, wk.commandTimeout(), wk.cancelc)
+	if result.status != popenCanceled {
+		wk.shared.metrics.add("logias_command_runs_total", 1, "target", wk.target.Path)
+		wk.shared.metrics.add("logias_command_duration_seconds_total", result.duration.Seconds(), "target", wk.target.Path)
+		wk.shared.metrics.set("logias_command_last_duration_seconds", result.duration.Seconds(), "target", wk.target.Path)
+		if result.status != 0 {
+			wk.shared.metrics.add("logias_command_failures_total", 1, "target", wk.target.Path)
+		}
+	}
+	switch result.status {
+	case 0:
+	case popenCanceled:
+		wk.logger().info("command canceled %s", wk.target.Path)
 		return
+	case popenTimeout:
+		wk.systemError(logLevelError.String(), "%s: %s", result.message, wk.target.Path)
+		return
+	case popenError:
+		wk.systemError(logLevelError.String(), "command failed %s: %s", wk.target.Path, result.message)
+		return
+	default:
+		if !wk.target.WithStatus {
+			wk.systemError(logLevelError.String(), "command failed %s: %s", wk.target.Path, result.failureMessage())
+			return
+		}
+	}
+	output := strings.Trim(result.stdout, " \t\n")
+	wk.trace("output: %s", output)
+
+	var lresult *lua.LTable
+	args := []lua.LValue{}
+	if wk.target.WithStatus {
+		lresult = wk.L.NewTable()
+		lresult.RawSetString("exit_status", lua.LNumber(result.status))
+		lresult.RawSetString("stdout", lua.LString(result.stdout))
+		lresult.RawSetString("stderr", lua.LString(result.stderr))
+		lresult.RawSetString("duration", lua.LNumber(result.duration.Seconds()))
+		args = append(args, lresult)
 	}
-	output = strings.Trim(output, " \t\n")
 
-	obj, ok := wk.applyParser(output)
+	obj, ok := wk.applyParser(output, args...)
 	if !ok {
 		return
 	}
 
-	for _, group := range wk.target.FilterGroups {
-		wk.applyFilterGroup(output, group, obj)
+	if lresult != nil {
+		if obj == lua.LNil {
+			obj = wk.L.NewTable()
+		}
+		// fields set by the parser take priority over the command result
+		if tbl, ok := obj.(*lua.LTable); ok {
+			lresult.ForEach(func(key, value lua.LValue) {
+				if tbl.RawGet(key) == lua.LNil {
+					tbl.RawSet(key, value)
+				}
+			})
+		}
 	}
+	wk.exportMetrics(obj)
+
+	wk.applyFilterGroups(output, obj)
 }
 
 func (wk *worker) processLua() {
@@ -163,47 +594,74 @@ func (wk *worker) processLua() {
 	}
 	obj := wk.popLuaRet()
 	output := luaToString(wk.L, obj)
-	for _, group := range wk.target.FilterGroups {
-		wk.applyFilterGroup(output, group, obj)
-	}
+	wk.trace("result: %s", output)
+	wk.exportMetrics(obj)
+	wk.applyFilterGroups(output, obj)
 }
 
-func (wk *worker) applyParser(line string) (lua.LValue, bool) {
+func (wk *worker) applyParser(line string, args ...lua.LValue) (lua.LValue, bool) {
 	obj := lua.LNil
 	if !lua.LVIsFalse(wk.target.Parser) && wk.target.Parser != nil {
-		if err := wk.callLua(wk.target.Parser, 1, lua.LString(line)); err != nil {
+		if err := wk.callLua(wk.target.Parser, 1, append([]lua.LValue{lua.LString(line)}, args...)...); err != nil {
 			wk.systemError(logLevelError.String(), "error while calling the parser function %s: %s", wk.target.Path, err.Error())
+			wk.shared.metrics.add("logias_parser_errors_total", 1, "target", wk.target.Path)
 			return lua.LNil, false
 		}
 		obj = wk.popLuaRet()
+		if wk.target.Debug {
+			// objects are serialized only when traced
+			wk.trace("parsed: %s", luaToString(wk.L, obj))
+		}
 	}
 	return obj, true
 }
 
-func (wk *worker) applyFilterGroup(line string, filterGroup []*filter, obj lua.LValue) {
-	for _, filter := range filterGroup {
+func (wk *worker) applyFilterGroups(line string, obj lua.LValue) {
+	for i, group := range wk.target.FilterGroups {
+		wk.applyFilterGroup(line, i+1, group, obj)
+	}
+}
+
+// trace writes a trace log if the target has the debug flag.
+func (wk *worker) trace(format string, args ...interface{}) {
+	if wk.target.Debug {
+		wk.logger().trace(format, args...)
+	}
+}
+
+func (wk *worker) applyFilterGroup(line string, groupNo int, filterGroup []*filter, obj lua.LValue) {
+	for i, filter := range filterGroup {
 		switch filter.Type {
 		case "match":
 			if !filter.regexp.MatchString(line) {
+				wk.trace("group %d filter %d: rejected by match(%s)", groupNo, i+1, filter.Pattern)
 				return
 			}
+			wk.trace("group %d filter %d: matched match(%s)", groupNo, i+1, filter.Pattern)
 		case "notmatch":
 			if filter.regexp.MatchString(line) {
+				wk.trace("group %d filter %d: rejected by notmatch(%s)", groupNo, i+1, filter.Pattern)
 				return
 			}
+			wk.trace("group %d filter %d: matched notmatch(%s)", groupNo, i+1, filter.Pattern)
 		case "test":
 			if err := wk.callLua(filter.Test, 1, wk.target.State, lua.LString(line), obj); err != nil {
 				wk.systemError(logLevelError.String(), "error while calling the test function %s: %s", wk.target.Path, err.Error())
 			}
 			ret := wk.popLuaRet()
 			if !lua.LVAsBool(ret) {
+				wk.trace("group %d filter %d: rejected by test", groupNo, i+1)
 				return
 			}
+			wk.trace("group %d filter %d: matched test", groupNo, i+1)
 		case "action":
+			wk.trace("group %d filter %d: action", groupNo, i+1)
 			if err := wk.callLua(filter.Fn, 0, wk.target.State, lua.LString(line), obj); err != nil {
 				wk.systemError(logLevelError.String(), "error while calling the action function %s: %s", wk.target.Path, err.Error())
 			}
 		case "notify":
+			wk.trace("group %d filter %d: notify(level=%s, code=%s)", groupNo, i+1, filter.Level, filter.Code)
+			wk.addMatchedLine(line)
 			message := filter.Message
 			if len(message) == 0 {
 				message = line
@@ -211,45 +669,93 @@ func (wk *worker) applyFilterGroup(line string, filterGroup []*filter, obj lua.L
 			wk.notify(message, obj, filter.Level, filter.Code)
 		}
 	}
+	wk.shared.metrics.add("logias_filter_group_matches_total", 1, "target", wk.target.Path, "group", strconv.Itoa(groupNo))
+}
+
+func (wk *worker) addMatchedLine(line string) {
+	wk.matchedLines = append(wk.matchedLines, line)
+	if len(wk.matchedLines) > maxMatchedLines {
+		wk.matchedLines = wk.matchedLines[len(wk.matchedLines)-maxMatchedLines:]
+	}
 }
 
 func (wk *worker) notify(message string, obj lua.LValue, level, code string) {
 	if wk.isInDowntime {
+		wk.trace("notification suppressed by the downtime: %s", message)
 		return
 	}
+	alevel, acode := level, code
+	if alevel == "nil" {
+		alevel = ""
+	}
+	if acode == "nil" {
+		acode = ""
+	}
+	inc, send := wk.shared.alerts.occur(wk.target.Path, alevel, acode, message, wk.config.alert())
+	if !send {
+		wk.logger().debug("notification of %s suppressed: %s", wk.target.Path, message)
+		wk.trace("notification suppressed by the alert window or the acknowledgement: %s", message)
+		return
+	}
+	wk.callNotifier(message, obj, level, code, inc)
+}
 
-	var fn *lua.LFunction
-	if len(code) != 0 {
-		if f, ok := wk.config.Notifiers.Code[code]; ok {
-			fn = f
+// processAlerts sends follow-up notifications of suppressed occurrences and
+// recovery notifications of resolved incidents.
+func (wk *worker) processAlerts() {
+	for _, inc := range wk.shared.alerts.due(wk.target.Path, wk.config.alert()) {
+		if inc.status == alertResolved {
+			wk.callNotifier(fmt.Sprintf("resolved: %s", inc.lastMessage), wk.L.NewTable(), logLevelInfo.String(), inc.code, inc)
+		} else {
+			wk.callNotifier(fmt.Sprintf("%d more occurrences: %s", inc.suppressed, inc.lastMessage), wk.L.NewTable(), inc.level, inc.code, inc)
 		}
 	}
-	if fn == nil && len(level) != 0 {
-		if f, ok := wk.config.Notifiers.Level[level]; ok {
-			fn = f
-		}
+}
+
+func (wk *worker) callNotifier(message string, obj lua.LValue, level, code string, inc *incident) {
+	name, fn := wk.config.notifierOf(level, code)
+	wk.trace("notifier %s chosen for level=%s, code=%s: %s", name, level, code, message)
+	if rl, ok := wk.config.RateLimits[name]; ok && !wk.shared.limiter.allow(name, rl, wk.target.Path, level, code, message) {
+		wk.logger().debug("notification of %s exceeded the rate limit of %s: %s", wk.target.Path, name, message)
+		wk.trace("notification exceeded the rate limit of %s: %s", name, message)
+		return
 	}
-	if fn == nil {
-		fn = wk.config.Notifiers.Default
+	wk.shared.metrics.add("logias_notifications_total", 1, "target", wk.target.Path, "level", level, "code", code)
+	var linc lua.LValue = lua.LNil
+	if inc != nil {
+		linc = inc.toLua(wk.L)
 	}
-	if err := wk.callLua(fn, 0, wk.target.State, obj, lua.LString(message), lua.LString(level), lua.LString(code)); err != nil {
+	if wk.config.delivery().Async {
+		n := newNotification(wk.target.Path, wk.currentPath, name, message, level, code, wk.target.State, obj, linc)
+		n.Lines = append([]string{}, wk.matchedLines...)
+		wk.shared.deliverer.enqueue(wk.logger(), wk.config.StatDir, n)
+		return
+	}
+	if err := wk.callLua(fn, 0, wk.target.State, obj, lua.LString(message), lua.LString(level), lua.LString(code), linc); err != nil {
 		wk.systemError(logLevelError.String(), "error while calling the notify function %s: %s", wk.target.Path, err.Error())
 	}
 }
 
-func (wk *worker) writeFileData(fd *fileData) {
-	path := filepath.Join(wk.config.StatDir, wk.target.dataPath())
-	err := writeFile(fmt.Sprintf("%s\n%s\n%d", wk.target.Path, fd.header, fd.position), path)
+func (wk *worker) writeFileData(path string, fd *fileData) {
+	dpath := filepath.Join(wk.config.StatDir, wk.target.fileDataPathOf(path))
+	err := writeFile(fmt.Sprintf("%s\n%s\n%d\n%d\n%d\n%s", path, fd.header, fd.position, fd.inode, fd.device, fd.checksum), dpath)
 	if err != nil {
-		wk.systemError(logLevelError.String(), "failed to write the stat file %s: %s", path, err.Error())
+		wk.systemError(logLevelError.String(), "failed to write the stat file %s: %s", dpath, err.Error())
 	}
 }
 
-func (wk *worker) readFileData() *fileData {
-	path := filepath.Join(wk.config.StatDir, wk.target.dataPath())
-	switch fileStat(path) {
+func (wk *worker) removeFileData(path string) {
+	dpath := filepath.Join(wk.config.StatDir, wk.target.fileDataPathOf(path))
+	if err := os.Remove(dpath); err != nil && !os.IsNotExist(err) {
+		wk.systemError(logLevelError.String(), "failed to remove the stat file %s: %s", dpath, err.Error())
+	}
+}
+
+func (wk *worker) readFileData(path string) *fileData {
+	dpath := filepath.Join(wk.config.StatDir, wk.target.fileDataPathOf(path))
+	switch fileStat(dpath) {
 	case ftDir:
-		wk.systemError(logLevelError.String(), "stat file %s is must be a file, not be a directory", path)
+		wk.systemError(logLevelError.String(), "stat file %s is must be a file, not be a directory", dpath)
 	case ftNotExists:
 		return &fileData{
 			header:   "",
@@ -257,9 +763,9 @@ func (wk *worker) readFileData() *fileData {
 		}
 	}
 
-	data, err := ioutil.ReadFile(path)
+	data, err := ioutil.ReadFile(dpath)
 	if err != nil {
-		wk.systemError(logLevelError.String(), "failed to read the stat file %s: %s", path, err.Error())
+		wk.systemError(logLevelError.String(), "failed to read the stat file %s: %s", dpath, err.Error())
 		return &fileData{
 			header:   "",
 			position: 0,
@@ -275,5 +781,96 @@ func (wk *worker) readFileData() *fileData {
 	if err == nil {
 		fd.position = i
 	}
+	// inode and device numbers are not written by older versions
+	if len(lines) > 4 {
+		if ino, err := strconv.ParseUint(lines[3], 10, 64); err == nil {
+			fd.inode = ino
+		}
+		if dev, err := strconv.ParseUint(lines[4], 10, 64); err == nil {
+			fd.device = dev
+		}
+	}
+	// checksums are not written by older versions
+	if len(lines) > 5 {
+		fd.checksum = lines[5]
+	}
 	return fd
 }
+
+// tailChecksumSize is a maximum number of bytes used for the checksum of
+// the read position.
+const tailChecksumSize = 64
+
+// tailChecksum returns a checksum of bytes just before the position, so that
+// a truncated file is detected even if it has grown beyond the position.
+func tailChecksum(fp *os.File, pos int64) string {
+	n := int64(tailChecksumSize)
+	if pos < n {
+		n = pos
+	}
+	if n <= 0 {
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, err := fp.ReadAt(buf, pos-n); err != nil {
+		return ""
+	}
+	return checksumOf(buf)
+}
+
+func checksumOf(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+// gzipContains returns true if the gzipped file has the content before the
+// read position of the fd. The uncompressed size is taken from the gzip
+// trailer and the content is confirmed by the checksum.
+func gzipContains(path string, fd *fileData) bool {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil || fi.Size() < 4 {
+		return false
+	}
+	trailer := make([]byte, 4)
+	if _, err := fp.ReadAt(trailer, fi.Size()-4); err != nil {
+		return false
+	}
+	// ISIZE is the uncompressed size modulo 2^32
+	size := int64(binary.LittleEndian.Uint32(trailer))
+	if fd.position < 1<<32 && size < fd.position {
+		return false
+	}
+	if len(fd.checksum) == 0 || fd.position <= 0 {
+		return true
+	}
+	gzr, err := gzip.NewReader(io.NewSectionReader(fp, 0, fi.Size()))
+	if err != nil {
+		return false
+	}
+	defer gzr.Close()
+	n := int64(tailChecksumSize)
+	if fd.position < n {
+		n = fd.position
+	}
+	if _, err := io.CopyN(ioutil.Discard, gzr, fd.position-n); err != nil {
+		return false
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(gzr, buf); err != nil {
+		return false
+	}
+	return checksumOf(buf) == fd.checksum
+}
+
+func tailChecksumOf(path string, pos int64) string {
+	fp, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+	return tailChecksum(fp, pos)
+}